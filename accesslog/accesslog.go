@@ -0,0 +1,249 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"hf-mirror/units"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	FormatJson     = "json"
+	FormatCombined = "combined"
+)
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Format is "json", one object per line, or "combined", the apache combined
+	// log format followed by the mirror's fields as key=value pairs.
+	Format string `yaml:"format"`
+	// Output is "stdout", "stderr" or the path of a file that is rotated once it grows past MaxSize.
+	Output  string         `yaml:"output"`
+	MaxSize units.ByteSize `yaml:"max_size"`
+	// MaxBackups and MaxAge bound the rotated files kept, zero keeps them all.
+	MaxBackups int           `yaml:"max_backups"`
+	MaxAge     time.Duration `yaml:"max_age"`
+	Compress   bool          `yaml:"compress"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Enabled:    true,
+		Format:     FormatJson,
+		Output:     "stdout",
+		MaxSize:    100 << 20,
+		MaxBackups: 10,
+		MaxAge:     time.Hour * 24 * 30,
+		Compress:   true,
+	}
+}
+
+// Entry is the access log line of one request, the proxy fills in what it
+// learns about the request while serving it.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	Method   string    `json:"method"`
+	Uri      string    `json:"uri"`
+	Proto    string    `json:"-"`
+	RepoType string    `json:"repo_type,omitempty"`
+	Repo     string    `json:"repo,omitempty"`
+	Revision string    `json:"revision,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Etag     string    `json:"etag,omitempty"`
+	// Tier is where the response came from, e.g. the meta cache, the local or remote blob cache or upstream.
+	Tier      string  `json:"tier,omitempty"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+}
+
+type entryKey struct{}
+
+// FromContext returns the entry of the request of ctx, nil when it is not logged.
+// The setters of Entry may be called on nil.
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	return e
+}
+
+func (e *Entry) SetFile(repoType, repo, revision, file string) {
+	if e != nil {
+		e.RepoType, e.Repo, e.Revision, e.File = repoType, repo, revision, file
+	}
+}
+
+func (e *Entry) SetEtag(etag string) {
+	if e != nil {
+		e.Etag = etag
+	}
+}
+
+func (e *Entry) SetTier(tier string) {
+	if e != nil {
+		e.Tier = tier
+	}
+}
+
+type Logger struct {
+	cfg *Config
+	out io.WriteCloser
+}
+
+func New(cfg *Config) (*Logger, error) {
+	l := &Logger{cfg: cfg}
+	if !cfg.Enabled {
+		return l, nil
+	}
+	if cfg.Format != FormatJson && cfg.Format != FormatCombined {
+		return nil, fmt.Errorf("invalid access log format %v", cfg.Format)
+	}
+	switch cfg.Output {
+	case "", "stdout":
+		l.out = nopCloser{os.Stdout}
+	case "stderr":
+		l.out = nopCloser{os.Stderr}
+	default:
+		l.out = &lumberjack.Logger{
+			Filename:   cfg.Output,
+			MaxSize:    int((cfg.MaxSize + (1<<20 - 1)) >> 20),
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     int((cfg.MaxAge + time.Hour*24 - 1) / (time.Hour * 24)),
+			Compress:   cfg.Compress,
+			LocalTime:  true,
+		}
+	}
+	return l, nil
+}
+
+// Handler writes an access log line for every request served by next.
+func (l *Logger) Handler(next http.Handler) http.Handler {
+	if l.out == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		e := &Entry{
+			Time:      time.Now(),
+			ClientIP:  clientIP(req),
+			Method:    req.Method,
+			Uri:       req.RequestURI,
+			Proto:     req.Proto,
+			Referer:   req.Referer(),
+			UserAgent: req.UserAgent(),
+		}
+		w := &responseWriter{ResponseWriter: rw}
+		defer func() {
+			e.Status, e.Bytes = w.status, w.bytes
+			if e.Status == 0 {
+				e.Status = http.StatusOK
+			}
+			e.Duration = time.Since(e.Time).Seconds()
+			l.write(e)
+		}()
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), entryKey{}, e)))
+	})
+}
+
+// Close closes the log file, if any.
+func (l *Logger) Close() error {
+	if l.out == nil {
+		return nil
+	}
+	return l.out.Close()
+}
+
+func (l *Logger) write(e *Entry) {
+	var line []byte
+	if l.cfg.Format == FormatCombined {
+		line = []byte(e.combined())
+	} else {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	}
+	// one write per line keeps concurrent lines whole
+	l.out.Write(line)
+}
+
+func (e *Entry) combined() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\"",
+		e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.Uri, e.Proto,
+		e.Status, e.Bytes, orDash(e.Referer), orDash(e.UserAgent))
+	fmt.Fprintf(&b, " tier=%s etag=%s repo_type=%s repo=%s revision=%s file=%q duration=%.3f\n",
+		orDash(e.Tier), orDash(e.Etag), orDash(e.RepoType), orDash(e.Repo), orDash(e.Revision), e.File, e.Duration)
+	return b.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom records the response like Write.
+func (w *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.bytes += n
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,46 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"hf-mirror/internal/writertest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseWriterKeepsReadFrom(t *testing.T) {
+	var rw *responseWriter
+	writertest.CopyThrough(t, func(w http.ResponseWriter) http.ResponseWriter {
+		rw = &responseWriter{ResponseWriter: w}
+		return rw
+	})
+	if rw.status != http.StatusOK || rw.bytes != int64(len(writertest.Body)) {
+		t.Errorf("logged status %v and %d bytes", rw.status, rw.bytes)
+	}
+}
+
+func TestHandlerLogsRequest(t *testing.T) {
+	l, err := New(NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	l.out = nopCloser{&out}
+	h := l.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		FromContext(req.Context()).SetTier("local")
+		rw.WriteHeader(http.StatusPartialContent)
+		io.Copy(rw, io.LimitReader(strings.NewReader("blob bytes"), 4))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/gpt2/resolve/main/model.bin", nil))
+
+	var e Entry
+	if err := json.Unmarshal(out.Bytes(), &e); err != nil {
+		t.Fatalf("invalid log line %q, %v", out.String(), err)
+	}
+	if e.Tier != "local" || e.Status != http.StatusPartialContent || e.Bytes != 4 || e.Uri != "/gpt2/resolve/main/model.bin" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
@@ -0,0 +1,191 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// downloads tracks the blobs being written into the cache dir, so that
+// concurrent requesters can follow a growing tmp file instead of fetching
+// the blob again.
+type downloads struct {
+	mux   sync.Mutex
+	items map[string]*download
+}
+
+func newDownloads() *downloads {
+	return &downloads{
+		items: make(map[string]*download),
+	}
+}
+
+type download struct {
+	registry *downloads
+	etag     string
+	tmpFile  string
+	size     int64
+
+	mux     sync.Mutex
+	cond    *sync.Cond
+	written int64
+	ranges  rangeSet
+	done    bool
+	ok      bool
+
+	// discarded is set under the registry lock when the blob was removed while
+	// being downloaded, its tmp file is dropped instead of committed then.
+	discarded bool
+}
+
+func (d *downloads) start(etag, tmpFile string, size int64) *download {
+	dl := &download{
+		registry: d,
+		etag:     etag,
+		tmpFile:  tmpFile,
+		size:     size,
+	}
+	dl.cond = sync.NewCond(&dl.mux)
+	d.mux.Lock()
+	d.items[etag] = dl
+	d.mux.Unlock()
+	return dl
+}
+
+func (dl *download) advance(n int64) {
+	dl.mux.Lock()
+	dl.ranges = dl.ranges.add(ByteRange{Start: dl.written, End: dl.written + n})
+	dl.written += n
+	dl.mux.Unlock()
+	dl.cond.Broadcast()
+}
+
+// finish runs commit, which renames the tmp file when ok or removes it, while
+// no reader can open it and wakes up the readers following it. A discarded
+// download is not committed, it returns false then.
+func (dl *download) finish(ok bool, commit func(ok bool) error) (bool, error) {
+	dl.registry.mux.Lock()
+	discarded := dl.discarded
+	err := commit(ok && !discarded)
+	if dl.registry.items[dl.etag] == dl {
+		delete(dl.registry.items, dl.etag)
+	}
+	dl.registry.mux.Unlock()
+
+	// readers following a discarded download still get the complete blob
+	dl.mux.Lock()
+	dl.done = true
+	dl.ok = ok && err == nil
+	dl.mux.Unlock()
+	dl.cond.Broadcast()
+	return ok && !discarded, err
+}
+
+// discard makes the in-progress download of etag drop its tmp file once it
+// finishes, later requesters no longer follow it. It returns false when none runs.
+func (d *downloads) discard(etag string) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	dl, ok := d.items[etag]
+	if ok {
+		dl.discarded = true
+		delete(d.items, etag)
+	}
+	return ok
+}
+
+// open returns a reader following the tmp file of an in-progress download of etag.
+func (d *downloads) open(etag string) (io.ReadCloser, int64, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	dl, ok := d.items[etag]
+	if !ok {
+		return nil, 0, false
+	}
+	fd, err := os.Open(dl.tmpFile)
+	if err != nil {
+		return nil, 0, false
+	}
+	return &tailReader{dl: dl, fd: fd}, dl.size, true
+}
+
+// tailReader reads a tmp file while it is being written, blocking until more
+// data is written or the download is finished.
+type tailReader struct {
+	dl  *download
+	fd  *os.File
+	pos int64
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	dl := t.dl
+	dl.mux.Lock()
+	for t.pos >= dl.written && !dl.done {
+		dl.cond.Wait()
+	}
+	written, done, ok := dl.written, dl.done, dl.ok
+	dl.mux.Unlock()
+	if done && !ok {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if t.pos >= written {
+		if t.pos == dl.size {
+			return 0, io.EOF
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > written-t.pos {
+		p = p[:written-t.pos]
+	}
+	n, err := t.fd.ReadAt(p, t.pos)
+	t.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (t *tailReader) Close() error {
+	return t.fd.Close()
+}
+
+// PartialBlob is random access to the tmp file of a blob being downloaded.
+type PartialBlob interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+	// Covering returns the already written byte range that contains offset.
+	Covering(offset int64) (ByteRange, bool)
+}
+
+func (d *downloads) openPartial(etag string) (PartialBlob, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	dl, ok := d.items[etag]
+	if !ok {
+		return nil, false
+	}
+	fd, err := os.Open(dl.tmpFile)
+	if err != nil {
+		return nil, false
+	}
+	return &partialBlob{dl: dl, File: fd}, true
+}
+
+type partialBlob struct {
+	dl *download
+	*os.File
+}
+
+func (p *partialBlob) Size() int64 {
+	return p.dl.size
+}
+
+func (p *partialBlob) Covering(offset int64) (ByteRange, bool) {
+	p.dl.mux.Lock()
+	defer p.dl.mux.Unlock()
+	if p.dl.done && !p.dl.ok {
+		return ByteRange{}, false
+	}
+	return p.dl.ranges.covering(offset)
+}
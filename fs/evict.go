@@ -0,0 +1,272 @@
+package fs
+
+import (
+	"container/list"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type CacheStats struct {
+	Blobs        int   `json:"blobs"`
+	Size         int64 `json:"size"`
+	Evictions    int64 `json:"evictions"`
+	EvictedBytes int64 `json:"evicted_bytes"`
+	// VerifyFailures counts downloads dropped because their digest did not match the etag.
+	VerifyFailures int64 `json:"verify_failures"`
+}
+
+type blobEntry struct {
+	etag    string
+	size    int64
+	readers int
+	elem    *list.Element
+}
+
+// lruIndex tracks the blobs of the cache dir ordered by last access, the most
+// recently used blob is at the front. Access times are persisted as the blob's
+// mtime so the order survives restarts.
+type lruIndex struct {
+	mux     sync.Mutex
+	blobdir string
+	entries map[string]*blobEntry
+	order   *list.List
+	stats   CacheStats
+
+	maxSize      int64
+	minFreeSpace int64
+	trigger      chan struct{}
+}
+
+func newLruIndex(blobdir string, maxSize, minFreeSpace int64) *lruIndex {
+	return &lruIndex{
+		blobdir:      blobdir,
+		entries:      make(map[string]*blobEntry),
+		order:        list.New(),
+		maxSize:      maxSize,
+		minFreeSpace: minFreeSpace,
+		trigger:      make(chan struct{}, 1),
+	}
+}
+
+// load indexes the blobs already in the cache dir, oldest first.
+func (l *lruIndex) load() error {
+	dirEntries, err := os.ReadDir(l.blobdir)
+	if err != nil {
+		return err
+	}
+	type blob struct {
+		etag  string
+		size  int64
+		mtime time.Time
+	}
+	var blobs []blob
+	for _, e := range dirEntries {
+		if e.IsDir() || IsTmpFile(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, blob{etag: e.Name(), size: info.Size(), mtime: info.ModTime()})
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].mtime.Before(blobs[j].mtime) })
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, b := range blobs {
+		l.addLocked(b.etag, b.size)
+	}
+	return nil
+}
+
+func (l *lruIndex) addLocked(etag string, size int64) {
+	if e, ok := l.entries[etag]; ok {
+		l.stats.Size += size - e.size
+		e.size = size
+		l.order.MoveToFront(e.elem)
+		return
+	}
+	e := &blobEntry{etag: etag, size: size}
+	e.elem = l.order.PushFront(e)
+	l.entries[etag] = e
+	l.stats.Blobs++
+	l.stats.Size += size
+}
+
+// add indexes a newly committed blob and schedules an eviction check.
+func (l *lruIndex) add(etag string, size int64) {
+	l.mux.Lock()
+	l.addLocked(etag, size)
+	l.mux.Unlock()
+	select {
+	case l.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// acquire marks etag as being streamed so that it is not evicted until the
+// returned release func is called, ok is false when etag is not cached (anymore).
+func (l *lruIndex) acquire(etag string) (release func(), ok bool) {
+	l.mux.Lock()
+	e, ok := l.entries[etag]
+	if ok {
+		e.readers++
+		l.order.MoveToFront(e.elem)
+	}
+	l.mux.Unlock()
+	if !ok {
+		return func() {}, false
+	}
+	now := time.Now()
+	os.Chtimes(filepath.Join(l.blobdir, etag), now, now)
+	return func() {
+		l.mux.Lock()
+		e.readers--
+		l.mux.Unlock()
+	}, true
+}
+
+// remove drops etag from the index, e.g. when the blob is purged.
+func (l *lruIndex) remove(etag string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	e, ok := l.entries[etag]
+	if !ok {
+		return
+	}
+	l.order.Remove(e.elem)
+	delete(l.entries, etag)
+	l.stats.Blobs--
+	l.stats.Size -= e.size
+}
+
+func (l *lruIndex) getStats() CacheStats {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.stats
+}
+
+func (l *lruIndex) freeSpace() (int64, error) {
+	return FreeSpace(l.blobdir)
+}
+
+// FreeSpace returns the bytes available to unprivileged users on the filesystem of dir.
+func FreeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// excess returns the bytes to free for the cache to be within its limits.
+func (l *lruIndex) excess() int64 {
+	var need int64
+	if l.minFreeSpace > 0 {
+		free, err := l.freeSpace()
+		if err != nil {
+			log.Warnf("stat free space of %v failed, err:%v", l.blobdir, err)
+		} else if free < l.minFreeSpace {
+			need = l.minFreeSpace - free
+		}
+	}
+	if l.maxSize > 0 {
+		l.mux.Lock()
+		if over := l.stats.Size - l.maxSize; over > need {
+			need = over
+		}
+		l.mux.Unlock()
+	}
+	return need
+}
+
+// pickVictims drops least recently used blobs that are not being streamed from
+// the index until need bytes would be freed, the caller removes their files.
+// Blobs dropped from the index can no longer be acquired.
+func (l *lruIndex) pickVictims(need int64) []*blobEntry {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	var victims []*blobEntry
+	var freed int64
+	for elem := l.order.Back(); elem != nil && freed < need; {
+		e := elem.Value.(*blobEntry)
+		elem = elem.Prev()
+		if e.readers > 0 {
+			continue
+		}
+		l.order.Remove(e.elem)
+		delete(l.entries, e.etag)
+		l.stats.Blobs--
+		l.stats.Size -= e.size
+		freed += e.size
+		victims = append(victims, e)
+	}
+	return victims
+}
+
+// evict removes least recently used blobs that are not being streamed until
+// the cache is within its limits. The index lock is not held while the disk is
+// stat'ed or files are removed, so requests are never blocked by an eviction.
+func (l *lruIndex) evict() {
+	for {
+		need := l.excess()
+		if need <= 0 {
+			return
+		}
+		victims := l.pickVictims(need)
+		removed := 0
+		for _, e := range victims {
+			if err := os.Remove(filepath.Join(l.blobdir, e.etag)); err != nil && !os.IsNotExist(err) {
+				log.WithFields(log.Fields{"etag": e.etag}).Errorf("evict blob failed, err:%v", err)
+				l.restore(e)
+				continue
+			}
+			removed++
+			l.mux.Lock()
+			l.stats.Evictions++
+			l.stats.EvictedBytes += e.size
+			l.mux.Unlock()
+			log.WithFields(log.Fields{"etag": e.etag, "size": e.size}).Infof("blob evicted from local cache")
+		}
+		if removed == 0 {
+			return
+		}
+	}
+}
+
+// restore puts back a victim whose file could not be removed as least recently
+// used, unless the blob was committed again meanwhile.
+func (l *lruIndex) restore(e *blobEntry) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if _, ok := l.entries[e.etag]; ok {
+		return
+	}
+	e.elem = l.order.PushBack(e)
+	l.entries[e.etag] = e
+	l.stats.Blobs++
+	l.stats.Size += e.size
+}
+
+func (l *lruIndex) run(interval time.Duration) {
+	if l.maxSize <= 0 && l.minFreeSpace <= 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.trigger:
+		}
+		l.evict()
+	}
+}
@@ -0,0 +1,37 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEvictSkipsAcquiredBlobs(t *testing.T) {
+	dir := t.TempDir()
+	l := newLruIndex(dir, 200, 0)
+	for _, etag := range []string{"old", "mid", "new"} {
+		if err := os.WriteFile(filepath.Join(dir, etag), make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		l.add(etag, 100)
+	}
+	release, ok := l.acquire("old")
+	if !ok {
+		t.Fatal("acquire of a cached blob failed")
+	}
+	l.evict()
+	release()
+
+	if _, err := os.Stat(filepath.Join(dir, "old")); err != nil {
+		t.Errorf("acquired blob evicted, err:%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "mid")); !os.IsNotExist(err) {
+		t.Errorf("least recently used blob kept, err:%v", err)
+	}
+	if _, ok := l.acquire("mid"); ok {
+		t.Error("evicted blob acquired")
+	}
+	if stats := l.getStats(); stats.Blobs != 2 || stats.Size != 200 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -2,12 +2,16 @@ package fs
 
 import (
 	log "github.com/sirupsen/logrus"
+	"hf-mirror/metrics"
+	"hf-mirror/units"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 const (
@@ -17,11 +21,27 @@ const (
 
 type LocalCacheConfig struct {
 	CacheDir string `yaml:"cache_dir"`
+	// MaxSize bounds the total size of cached blobs, least recently used blobs are evicted beyond it, 0 disables it.
+	MaxSize units.ByteSize `yaml:"max_size"`
+	// MinFreeSpace is the free space kept on the cache dir's filesystem, 0 disables it.
+	MinFreeSpace  units.ByteSize `yaml:"min_free_space"`
+	EvictInterval time.Duration  `yaml:"evict_interval"`
+	// Verify checks downloaded blobs against their etag before they are committed, one of "none", "lfs" or "all".
+	Verify string `yaml:"verify"`
+}
+
+// IsTmpFile reports whether name in the cache dir is a blob still being downloaded.
+func IsTmpFile(name string) bool {
+	return strings.HasSuffix(name, tmpfile_suffix)
 }
 
 func NewConfig() *LocalCacheConfig {
 	return &LocalCacheConfig{
-		CacheDir: defaultBlobDir,
+		CacheDir:      defaultBlobDir,
+		MaxSize:       0,
+		MinFreeSpace:  0,
+		EvictInterval: time.Minute,
+		Verify:        VerifyLfs,
 	}
 }
 
@@ -30,31 +50,120 @@ type FileLocalCache interface {
 	HasFile(etag string) bool
 	GetFilePath(etag string) string
 	FileHandler() http.Handler
+	// Acquire protects etag from eviction while it is streamed, until release is
+	// called. ok is false when the blob is not cached, e.g. it was just evicted.
+	Acquire(etag string) (release func(), ok bool)
+	// OpenDownloading follows the tmp file of a blob that is still being downloaded, ok is false when there is none.
+	OpenDownloading(etag string) (rd io.ReadCloser, size int64, ok bool)
+	// OpenPartial gives random access to the already written ranges of a blob that is still being downloaded.
+	OpenPartial(etag string) (PartialBlob, bool)
+	// Remove deletes the blob of etag, readers that opened it already keep reading it.
+	// An in-progress download of etag is discarded instead of committed when it finishes.
+	Remove(etag string) error
+	Stats() CacheStats
 }
 
 type fileLocalCache struct {
 	fsHandler http.Handler
 	blobdir   string
+	index     *lruIndex
+	verify    string
+	downloads *downloads
+
+	verifyFailures int64
 }
 
 func NewFileCache(cfg *LocalCacheConfig) FileLocalCache {
 	os.MkdirAll(cfg.CacheDir, 0766)
-	return &fileLocalCache{
+	removeStaleTmpFiles(cfg.CacheDir)
+	index := newLruIndex(cfg.CacheDir, int64(cfg.MaxSize), int64(cfg.MinFreeSpace))
+	if err := index.load(); err != nil {
+		log.WithFields(log.Fields{"dir": cfg.CacheDir}).Errorf("index local cache failed, err:%v", err)
+	}
+	go index.run(cfg.EvictInterval)
+	c := &fileLocalCache{
 		fsHandler: http.FileServer(http.Dir(cfg.CacheDir)),
 		blobdir:   cfg.CacheDir,
+		index:     index,
+		verify:    cfg.Verify,
+		downloads: newDownloads(),
+	}
+	c.registerMetrics()
+	return c
+}
+
+// removeStaleTmpFiles deletes the tmp files of downloads that were aborted by
+// a crash or a shutdown, the ones still locked by another process are kept.
+func removeStaleTmpFiles(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.WithFields(log.Fields{"dir": dir}).Errorf("list stale tmp files failed, err:%v", err)
+		return
+	}
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || !IsTmpFile(e.Name()) {
+			continue
+		}
+		file := filepath.Join(dir, e.Name())
+		fd, err := os.OpenFile(file, os.O_WRONLY, 0644)
+		if err != nil {
+			continue
+		}
+		if err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+			if err = os.Remove(file); err != nil {
+				log.WithFields(log.Fields{"file": file}).Errorf("remove stale tmp file failed, err:%v", err)
+			} else {
+				removed++
+			}
+		}
+		// closing drops the lock
+		fd.Close()
+	}
+	if removed > 0 {
+		log.WithFields(log.Fields{"dir": dir, "removed": removed}).Infof("removed tmp files of aborted downloads")
 	}
 }
 
+func (f *fileLocalCache) registerMetrics() {
+	metrics.GaugeFunc("local_cache_bytes", "Size of the blobs in the local cache.", func() float64 {
+		return float64(f.index.getStats().Size)
+	})
+	metrics.GaugeFunc("local_cache_blobs", "Number of blobs in the local cache.", func() float64 {
+		return float64(f.index.getStats().Blobs)
+	})
+	metrics.GaugeFunc("local_cache_free_bytes", "Free space of the filesystem of the local cache.", func() float64 {
+		free, err := f.index.freeSpace()
+		if err != nil {
+			return 0
+		}
+		return float64(free)
+	})
+	metrics.CounterFunc("local_cache_evicted_bytes_total", "Bytes of blobs evicted from the local cache.", func() float64 {
+		return float64(f.index.getStats().EvictedBytes)
+	})
+	metrics.CounterFunc("blob_verify_failures_total", "Downloads dropped because their digest did not match the etag.", func() float64 {
+		return float64(atomic.LoadInt64(&f.verifyFailures))
+	})
+}
+
 type fileDownloadWriter struct {
 	fd        int
 	tmpFile   string
 	expectLen int64
 	readLen   int64
 	io.WriteCloser
+	verifier *blobVerifier
+	progress *download
 	onFinish func()
+	onFailed func(err error)
 }
 
-func NewFileDownloadWriter(file string, expectLen int64, onFinish func()) (io.WriteCloser, error) {
+func NewFileDownloadWriter(file string, expectLen int64, verifier *blobVerifier, onFinish func(), onFailed func(err error)) (io.WriteCloser, error) {
+	return newFileDownloadWriter(file, expectLen, verifier, onFinish, onFailed)
+}
+
+func newFileDownloadWriter(file string, expectLen int64, verifier *blobVerifier, onFinish func(), onFailed func(err error)) (*fileDownloadWriter, error) {
 	file = file + tmpfile_suffix
 	fd, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
@@ -63,6 +172,12 @@ func NewFileDownloadWriter(file string, expectLen int64, onFinish func()) (io.Wr
 	}
 	fdInt := int(fd.Fd())
 	if err := syscall.Flock(fdInt, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	// drop whatever an aborted download left behind
+	if err := fd.Truncate(0); err != nil {
+		fd.Close()
 		return nil, err
 	}
 	return &fileDownloadWriter{
@@ -70,19 +185,28 @@ func NewFileDownloadWriter(file string, expectLen int64, onFinish func()) (io.Wr
 		expectLen:   expectLen,
 		WriteCloser: fd,
 		fd:          fdInt,
+		verifier:    verifier,
 		onFinish:    onFinish,
+		onFailed:    onFailed,
 	}, nil
 }
 
 func (f *fileDownloadWriter) Close() error {
-	var err error
-	if f.readLen == f.expectLen {
-		err = os.Rename(f.tmpFile, strings.TrimSuffix(f.tmpFile, tmpfile_suffix))
-		if err == nil {
-			f.onFinish()
+	complete := f.complete()
+	commit := func(complete bool) error {
+		if complete {
+			return os.Rename(f.tmpFile, strings.TrimSuffix(f.tmpFile, tmpfile_suffix))
 		}
+		return os.RemoveAll(f.tmpFile)
+	}
+	var err error
+	if f.progress != nil {
+		complete, err = f.progress.finish(complete, commit)
 	} else {
-		err = os.RemoveAll(f.tmpFile)
+		err = commit(complete)
+	}
+	if err == nil && complete {
+		f.onFinish()
 	}
 	if err != nil {
 		return err
@@ -93,17 +217,52 @@ func (f *fileDownloadWriter) Close() error {
 	return f.WriteCloser.Close()
 }
 
+// complete reports whether the whole blob was written and matches its etag.
+func (f *fileDownloadWriter) complete() bool {
+	if f.readLen != f.expectLen {
+		return false
+	}
+	if f.verifier == nil {
+		return true
+	}
+	if err := f.verifier.verify(); err != nil {
+		log.WithFields(log.Fields{"file": f.tmpFile}).Errorf("verify downloaded blob failed, err:%v", err)
+		f.onFailed(err)
+		return false
+	}
+	return true
+}
+
 func (f *fileDownloadWriter) Write(p []byte) (n int, err error) {
 	n, err = f.WriteCloser.Write(p)
 	if n >= 0 {
 		f.readLen += int64(n)
+		if f.verifier != nil {
+			f.verifier.Write(p[:n])
+		}
+		if f.progress != nil {
+			f.progress.advance(int64(n))
+		}
 	}
 	return n, err
 }
 
 func (f *fileLocalCache) CreateBlobWriter(etag string, expectLen int64, onFinish func()) (io.WriteCloser, error) {
 	file := filepath.Join(f.blobdir, etag)
-	return NewFileDownloadWriter(file, expectLen, onFinish)
+	verifier := newBlobVerifier(f.verify, etag, expectLen)
+	w, err := newFileDownloadWriter(file, expectLen, verifier, func() {
+		f.index.add(etag, expectLen)
+		if onFinish != nil {
+			onFinish()
+		}
+	}, func(err error) {
+		atomic.AddInt64(&f.verifyFailures, 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.progress = f.downloads.start(etag, w.tmpFile, expectLen)
+	return w, nil
 }
 
 func (f *fileLocalCache) HasFile(etag string) bool {
@@ -122,3 +281,32 @@ func (f *fileLocalCache) GetFilePath(etag string) string {
 func (f *fileLocalCache) FileHandler() http.Handler {
 	return f.fsHandler
 }
+
+func (f *fileLocalCache) Acquire(etag string) (release func(), ok bool) {
+	return f.index.acquire(etag)
+}
+
+func (f *fileLocalCache) Stats() CacheStats {
+	stats := f.index.getStats()
+	stats.VerifyFailures = atomic.LoadInt64(&f.verifyFailures)
+	return stats
+}
+
+func (f *fileLocalCache) OpenDownloading(etag string) (io.ReadCloser, int64, bool) {
+	return f.downloads.open(etag)
+}
+
+func (f *fileLocalCache) OpenPartial(etag string) (PartialBlob, bool) {
+	return f.downloads.openPartial(etag)
+}
+
+func (f *fileLocalCache) Remove(etag string) error {
+	if f.downloads.discard(etag) {
+		log.WithFields(log.Fields{"etag": etag}).Infof("in-progress download of removed blob discarded")
+	}
+	f.index.remove(etag)
+	if err := os.Remove(filepath.Join(f.blobdir, etag)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
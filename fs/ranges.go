@@ -0,0 +1,91 @@
+package fs
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ByteRange is the half open byte range [Start, End).
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// ParseRange parses a Range header holding a single byte range against a blob of size.
+func ParseRange(header string, size int64) (ByteRange, bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return ByteRange{}, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return ByteRange{}, false
+	}
+	if first == "" {
+		// suffix range, the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return ByteRange{}, false
+		}
+		if n > size {
+			n = size
+		}
+		return ByteRange{Start: size - n, End: size}, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return ByteRange{}, false
+	}
+	end := size
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < start {
+			return ByteRange{}, false
+		}
+		if n+1 < end {
+			end = n + 1
+		}
+	}
+	return ByteRange{Start: start, End: end}, true
+}
+
+// rangeSet is a sorted list of disjoint, non adjacent byte ranges.
+type rangeSet []ByteRange
+
+// add merges r into s in place, it runs for every chunk written to a download
+// so extending the last range must not allocate.
+func (s rangeSet) add(r ByteRange) rangeSet {
+	if r.End <= r.Start {
+		return s
+	}
+	i := sort.Search(len(s), func(i int) bool { return s[i].End >= r.Start })
+	j := i
+	for j < len(s) && s[j].Start <= r.End {
+		if s[j].Start < r.Start {
+			r.Start = s[j].Start
+		}
+		if s[j].End > r.End {
+			r.End = s[j].End
+		}
+		j++
+	}
+	if j == i {
+		// r touches no range, make room for it
+		s = append(s, ByteRange{})
+		copy(s[i+1:], s[i:])
+		s[i] = r
+		return s
+	}
+	s[i] = r
+	return append(s[:i+1], s[j:]...)
+}
+
+// covering returns the range containing offset.
+func (s rangeSet) covering(offset int64) (ByteRange, bool) {
+	i := sort.Search(len(s), func(i int) bool { return s[i].End > offset })
+	if i < len(s) && s[i].Start <= offset {
+		return s[i], true
+	}
+	return ByteRange{}, false
+}
@@ -0,0 +1,41 @@
+package fs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRangeSetAdd(t *testing.T) {
+	cases := []struct {
+		add  []ByteRange
+		want rangeSet
+	}{
+		{[]ByteRange{{0, 10}, {10, 20}}, rangeSet{{0, 20}}},
+		{[]ByteRange{{20, 30}, {0, 10}}, rangeSet{{0, 10}, {20, 30}}},
+		{[]ByteRange{{0, 10}, {20, 30}, {40, 50}, {5, 45}}, rangeSet{{0, 50}}},
+		{[]ByteRange{{0, 10}, {40, 50}, {20, 30}}, rangeSet{{0, 10}, {20, 30}, {40, 50}}},
+		{[]ByteRange{{0, 10}, {20, 30}, {40, 50}, {25, 35}}, rangeSet{{0, 10}, {20, 35}, {40, 50}}},
+		{[]ByteRange{{10, 20}, {5, 5}}, rangeSet{{10, 20}}},
+	}
+	for _, c := range cases {
+		var s rangeSet
+		for _, r := range c.add {
+			s = s.add(r)
+		}
+		if !reflect.DeepEqual(s, c.want) {
+			t.Errorf("add %v: got %v, want %v", c.add, s, c.want)
+		}
+	}
+}
+
+func TestRangeSetExtendDoesNotAllocate(t *testing.T) {
+	s := rangeSet{{0, 10}, {20, 30}}
+	end := int64(30)
+	allocs := testing.AllocsPerRun(100, func() {
+		s = s.add(ByteRange{Start: end, End: end + 10})
+		end += 10
+	})
+	if allocs != 0 {
+		t.Errorf("extending the last range allocated %v times", allocs)
+	}
+}
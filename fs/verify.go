@@ -0,0 +1,55 @@
+package fs
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+)
+
+const (
+	// VerifyNone commits downloaded blobs after a length check only.
+	VerifyNone = "none"
+	// VerifyLfs checks lfs blobs, whose etag is their sha256.
+	VerifyLfs = "lfs"
+	// VerifyAll also checks regular files, whose etag is their git blob sha1.
+	VerifyAll = "all"
+)
+
+var (
+	sha256EtagReg = regexp.MustCompile("^[0-9a-f]{64}$")
+	sha1EtagReg   = regexp.MustCompile("^[0-9a-f]{40}$")
+)
+
+// blobVerifier hashes a blob while it is streamed and compares the digest with its etag.
+type blobVerifier struct {
+	h      hash.Hash
+	expect string
+}
+
+// newBlobVerifier returns nil when mode does not verify blobs with this kind of etag.
+func newBlobVerifier(mode, etag string, size int64) *blobVerifier {
+	switch {
+	case (mode == VerifyLfs || mode == VerifyAll) && sha256EtagReg.MatchString(etag):
+		return &blobVerifier{h: sha256.New(), expect: etag}
+	case mode == VerifyAll && sha1EtagReg.MatchString(etag):
+		h := sha1.New()
+		h.Write([]byte("blob " + strconv.FormatInt(size, 10) + "\x00"))
+		return &blobVerifier{h: h, expect: etag}
+	}
+	return nil
+}
+
+func (v *blobVerifier) Write(p []byte) (int, error) {
+	return v.h.Write(p)
+}
+
+func (v *blobVerifier) verify() error {
+	if sum := hex.EncodeToString(v.h.Sum(nil)); sum != v.expect {
+		return fmt.Errorf("digest mismatch, expect:%v, got:%v", v.expect, sum)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hf-mirror/fs"
+	"hf-mirror/oss"
+	"hf-mirror/units"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Addr is a separate listener of the probes, they are served on the proxy listener when it is empty.
+	Addr string `yaml:"addr"`
+	// LivePath and ReadyPath are where the liveness and readiness probes are served.
+	LivePath  string `yaml:"live_path"`
+	ReadyPath string `yaml:"ready_path"`
+	// Timeout bounds each check.
+	Timeout time.Duration `yaml:"timeout"`
+	// CacheFor is how long the result of a check is reused by later probes, so
+	// that frequent probes do not send a request to the bucket and the hub each.
+	CacheFor time.Duration `yaml:"cache_for"`
+	// MinFreeSpace is the free space of the cache dir below which the mirror is not ready.
+	MinFreeSpace units.ByteSize `yaml:"min_free_space"`
+	// RequireRemote and RequireUpstream make the mirror unready while the bucket
+	// or the hub is unreachable, otherwise they are only reported.
+	RequireRemote   bool `yaml:"require_remote"`
+	RequireUpstream bool `yaml:"require_upstream"`
+	// UploadStallAfter fails liveness when an upload to the remote cache runs
+	// for longer, 0 only reports the upload workers.
+	UploadStallAfter time.Duration `yaml:"upload_stall_after"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Enabled:          true,
+		Addr:             "",
+		LivePath:         "/healthz",
+		ReadyPath:        "/readyz",
+		Timeout:          time.Second * 5,
+		CacheFor:         time.Second * 5,
+		MinFreeSpace:     1 << 30,
+		RequireRemote:    false,
+		RequireUpstream:  false,
+		UploadStallAfter: 0,
+	}
+}
+
+// Level decides which probes a failing check fails.
+type Level int
+
+const (
+	// Info checks are reported but fail no probe.
+	Info Level = iota
+	// Ready checks fail readiness.
+	Ready
+	// Live checks fail liveness and readiness, the mirror is restarted.
+	Live
+)
+
+// CheckFunc returns a detail that is reported along the result, e.g. the free space.
+type CheckFunc func(ctx context.Context) (detail any, err error)
+
+type check struct {
+	name  string
+	level Level
+	fn    CheckFunc
+
+	mux sync.Mutex
+	// running is closed once the run in progress stored its result in last.
+	running chan struct{}
+	last    *Result
+	lastAt  time.Time
+}
+
+type Checker struct {
+	cfg    *Config
+	mux    sync.Mutex
+	checks []*check
+}
+
+func NewChecker(cfg *Config) *Checker {
+	return &Checker{cfg: cfg}
+}
+
+// Add registers a check, readiness runs all checks and liveness only the Live ones.
+func (c *Checker) Add(name string, level Level, fn CheckFunc) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.checks = append(c.checks, &check{name: name, level: level, fn: fn})
+}
+
+type Result struct {
+	Status   string  `json:"status"`
+	Detail   any     `json:"detail,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+type Report struct {
+	Status string             `json:"status"`
+	Checks map[string]*Result `json:"checks"`
+}
+
+const (
+	StatusOk       = "ok"
+	StatusDegraded = "degraded"
+	StatusFail     = "fail"
+)
+
+// Run runs the checks of probe concurrently, ok is false when a check whose level fails probe failed.
+func (c *Checker) Run(ctx context.Context, probe Level) (report *Report, ok bool) {
+	c.mux.Lock()
+	var checks []*check
+	for _, chk := range c.checks {
+		if probe != Live || chk.level == Live {
+			checks = append(checks, chk)
+		}
+	}
+	c.mux.Unlock()
+
+	report = &Report{Status: StatusOk, Checks: make(map[string]*Result, len(checks))}
+	results := make([]*Result, len(checks))
+	var wg sync.WaitGroup
+	for i, chk := range checks {
+		wg.Add(1)
+		go func(i int, chk *check) {
+			defer wg.Done()
+			results[i] = c.run(ctx, chk)
+		}(i, chk)
+	}
+	wg.Wait()
+	ok = true
+	for i, chk := range checks {
+		res := results[i]
+		report.Checks[chk.name] = res
+		if res.Status == StatusOk {
+			continue
+		}
+		if chk.level >= probe {
+			res.Status = StatusFail
+			report.Status, ok = StatusFail, false
+		} else if report.Status == StatusOk {
+			report.Status = StatusDegraded
+		}
+	}
+	return report, ok
+}
+
+// run returns the cached result of chk, or that of a fresh run. A probe joins
+// the run in progress instead of starting another one, so a check that hangs
+// on e.g. a stat of a dead mount ties up a single goroutine however often it
+// is probed. The probe gives up on it after the timeout.
+func (c *Checker) run(ctx context.Context, chk *check) *Result {
+	start := time.Now()
+	chk.mux.Lock()
+	if chk.last != nil && time.Since(chk.lastAt) < c.cfg.CacheFor {
+		res := *chk.last
+		chk.mux.Unlock()
+		return &res
+	}
+	running := chk.running
+	if running == nil {
+		running = make(chan struct{})
+		chk.running = running
+		go c.runCheck(chk, running)
+	}
+	chk.mux.Unlock()
+
+	timer := time.NewTimer(c.cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case <-running:
+	case <-timer.C:
+		return &Result{Status: StatusDegraded, Error: "check timed out", Duration: time.Since(start).Seconds()}
+	case <-ctx.Done():
+		return &Result{Status: StatusDegraded, Error: ctx.Err().Error(), Duration: time.Since(start).Seconds()}
+	}
+	chk.mux.Lock()
+	res := *chk.last
+	chk.mux.Unlock()
+	return &res
+}
+
+// runCheck runs chk detached from the probes waiting for it and caches the result.
+func (c *Checker) runCheck(chk *check, running chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+	defer cancel()
+	start := time.Now()
+	res := &Result{Status: StatusOk}
+	detail, err := chk.fn(ctx)
+	res.Detail = detail
+	if err != nil {
+		res.Status, res.Error = StatusDegraded, err.Error()
+	}
+	res.Duration = time.Since(start).Seconds()
+	chk.mux.Lock()
+	chk.last, chk.lastAt = res, time.Now()
+	chk.running = nil
+	chk.mux.Unlock()
+	close(running)
+}
+
+// Handler serves the liveness and readiness probes and passes any other request to next.
+func Handler(cfg *Config, c *Checker, next http.Handler) http.Handler {
+	if !cfg.Enabled {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var probe Level
+		switch req.URL.Path {
+		case cfg.LivePath:
+			probe = Live
+		case cfg.ReadyPath:
+			probe = Ready
+		default:
+			next.ServeHTTP(rw, req)
+			return
+		}
+		report, ok := c.Run(req.Context(), probe)
+		code := http.StatusOK
+		if !ok {
+			code = http.StatusServiceUnavailable
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.WriteHeader(code)
+		json.NewEncoder(rw).Encode(report)
+	})
+}
+
+// IsProbe reports whether path is a probe served on the proxy listener.
+func (cfg *Config) IsProbe(path string) bool {
+	return cfg.Enabled && cfg.Addr == "" && (path == cfg.LivePath || path == cfg.ReadyPath)
+}
+
+// DirWritable checks that a file can be created in dir.
+func DirWritable(dir string) CheckFunc {
+	return func(ctx context.Context) (any, error) {
+		// named like a download in progress, so the cache never takes it for a blob
+		fp, err := os.CreateTemp(dir, ".healthcheck-*_tmp")
+		if err != nil {
+			return nil, err
+		}
+		name := fp.Name()
+		_, err = fp.Write([]byte("ok"))
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+		os.Remove(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write %v, %v", filepath.Base(name), err)
+		}
+		return nil, nil
+	}
+}
+
+// FreeSpace checks that the filesystem of dir has at least min bytes available.
+func FreeSpace(dir string, min units.ByteSize) CheckFunc {
+	return func(ctx context.Context) (any, error) {
+		free, err := fs.FreeSpace(dir)
+		if err != nil {
+			return nil, err
+		}
+		detail := map[string]int64{"free_bytes": free, "min_free_bytes": int64(min)}
+		if free < int64(min) {
+			return detail, fmt.Errorf("cache disk is full, %d bytes free", free)
+		}
+		return detail, nil
+	}
+}
+
+// UploadWorkers reports the upload queue of remote, it fails once an upload runs for longer than stallAfter.
+func UploadWorkers(remote oss.RemoteCache, stallAfter time.Duration) CheckFunc {
+	return func(ctx context.Context) (any, error) {
+		stats := remote.UploadStats()
+		if stallAfter > 0 && stats.InflightSince != nil && time.Since(*stats.InflightSince) > stallAfter {
+			return stats, fmt.Errorf("upload running since %v", stats.InflightSince.Format(time.RFC3339))
+		}
+		return stats, nil
+	}
+}
+
+// RemoteCache checks that the bucket of remote is reachable.
+func RemoteCache(remote oss.RemoteCache) CheckFunc {
+	return func(ctx context.Context) (any, error) {
+		return nil, remote.Ping(ctx)
+	}
+}
@@ -0,0 +1,71 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestChecker(cacheFor time.Duration) *Checker {
+	cfg := NewConfig()
+	cfg.Timeout = time.Millisecond * 100
+	cfg.CacheFor = cacheFor
+	return NewChecker(cfg)
+}
+
+func TestCheckResultIsCached(t *testing.T) {
+	c := newTestChecker(time.Hour)
+	var calls int32
+	c.Add("bucket", Ready, func(ctx context.Context) (any, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("unreachable")
+	})
+	for i := 0; i < 3; i++ {
+		report, ok := c.Run(context.Background(), Ready)
+		if ok || report.Checks["bucket"].Status != StatusFail {
+			t.Fatalf("failing check passed, report %+v", report.Checks["bucket"])
+		}
+	}
+	if calls != 1 {
+		t.Errorf("check ran %d times, want its result cached", calls)
+	}
+	// a cached failure must not be reported as failed to a probe it does not fail
+	if report, ok := c.Run(context.Background(), Live); !ok || len(report.Checks) != 0 {
+		t.Errorf("liveness failed on a ready check, report %+v", report)
+	}
+}
+
+func TestHungCheckRunsOnce(t *testing.T) {
+	c := newTestChecker(0)
+	var calls int32
+	release := make(chan struct{})
+	c.Add("mount", Ready, func(ctx context.Context) (any, error) {
+		atomic.AddInt32(&calls, 1)
+		// ignores ctx like a stat of a dead mount
+		<-release
+		return nil, nil
+	})
+	for i := 0; i < 3; i++ {
+		report, ok := c.Run(context.Background(), Ready)
+		if ok || report.Checks["mount"].Error != "check timed out" {
+			t.Fatalf("hung check passed, report %+v", report.Checks["mount"])
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("hung check started %d times", n)
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if _, ok := c.Run(context.Background(), Ready); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("check did not recover")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,41 @@
+// Package writertest checks that response writer wrappers keep the sendfile
+// path of the writer they wrap.
+package writertest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Body is what CopyThrough copies.
+const Body = "blob bytes"
+
+// sendfileWriter records whether the response was copied with ReadFrom.
+type sendfileWriter struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (w *sendfileWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, r)
+}
+
+// CopyThrough copies Body through the writer wrap returns, like
+// http.ServeContent does with a reader that is no io.WriterTo, and fails t
+// unless the ReadFrom of the wrapped writer was used.
+func CopyThrough(t *testing.T, wrap func(http.ResponseWriter) http.ResponseWriter) *httptest.ResponseRecorder {
+	t.Helper()
+	w := &sendfileWriter{ResponseRecorder: httptest.NewRecorder()}
+	n, err := io.Copy(wrap(w), io.LimitReader(strings.NewReader(Body), int64(len(Body))))
+	if err != nil || n != int64(len(Body)) {
+		t.Fatalf("copied %d bytes, err:%v", n, err)
+	}
+	if !w.readFrom {
+		t.Error("ReadFrom of the wrapped writer not used")
+	}
+	return w.ResponseRecorder
+}
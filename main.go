@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
+	"hf-mirror/accesslog"
 	"hf-mirror/fs"
+	"hf-mirror/health"
 	"hf-mirror/metacache"
+	"hf-mirror/metrics"
 	"hf-mirror/oss"
 	"hf-mirror/proxy"
+	"hf-mirror/tracing"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
+// traceFlushTimeout bounds the export of the spans left on shutdown.
+const traceFlushTimeout = 5 * time.Second
+
 func init() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(os.Stdout)
@@ -19,37 +31,188 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "prefetch" {
+		os.Exit(runPrefetch(os.Args[2:]))
+	}
 	cfg, err := loadConfig()
 	if err != nil {
 		panic(err)
 	}
+	shutdownTracing, err := tracing.Init(cfg.Tracing)
+	if err != nil {
+		panic(err)
+	}
+	cfg.MetaCache.OwnersPath = ownersPath(cfg)
 	metaCache := metacache.NewMetaDataCache(cfg.MetaCache)
 	localCache := fs.NewFileCache(cfg.LocalCache)
 	remoteCache := oss.NewRemoteCache(cfg.RemoteCache)
+	if cfg.RemoteCache.ReconcileOnStart {
+		go func() {
+			if err := remoteCache.Reconcile(cfg.LocalCache.CacheDir); err != nil {
+				log.Errorf("reconcile remote cache failed, err:%v", err)
+			}
+		}()
+	}
 	h := proxy.NewHFProxy(cfg.Proxy, metaCache, localCache, remoteCache)
 	http.Handle("/", h)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 4)
+	var adminServer, metricsServer *http.Server
+	if cfg.Admin.Addr != "" {
+		admin, err := proxy.NewAdminHandler(cfg.Admin, h)
+		if err != nil {
+			panic(err)
+		}
+		adminServer = &http.Server{Addr: cfg.Admin.Addr, Handler: admin}
+		go func() {
+			serveErr <- adminServer.ListenAndServe()
+		}()
+	}
+	if cfg.Metrics.Enabled {
+		metricsServer = &http.Server{Addr: cfg.Metrics.Addr, Handler: metrics.Handler(cfg.Metrics)}
+		go func() {
+			serveErr <- metricsServer.ListenAndServe()
+		}()
+	}
 
+	accessLog, err := accesslog.New(cfg.AccessLog)
+	if err != nil {
+		panic(err)
+	}
+	checker, err := newHealthChecker(cfg, h, remoteCache)
+	if err != nil {
+		panic(err)
+	}
+	handler := accessLog.Handler(h)
+	var probeServer *http.Server
+	if cfg.Health.Addr == "" {
+		handler = health.Handler(cfg.Health, checker, handler)
+	} else if cfg.Health.Enabled {
+		probeServer = &http.Server{Addr: cfg.Health.Addr, Handler: health.Handler(cfg.Health, checker, http.NotFoundHandler())}
+		go func() {
+			serveErr <- probeServer.ListenAndServe()
+		}()
+	}
 	server := &http.Server{
-		Addr:    cfg.Proxy.Addr,
-		Handler: h,
+		Addr: cfg.Proxy.Addr,
+		Handler: tracing.Handler(handler, func(req *http.Request) bool {
+			return cfg.Health.IsProbe(req.URL.Path)
+		}),
+	}
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	exitCode := 0
+	select {
+	case err := <-serveErr:
+		log.Errorf("serve failed, err:%v", err)
+		exitCode = 1
+	case <-ctx.Done():
+	}
+	// a second signal kills the process right away
+	stop()
+
+	// every phase gets a budget of its own, so that a slow drain does not
+	// abort the uploads right away or drop the traces of the shutdown
+	log.Infof("shutting down, waiting up to %v for in-flight downloads", cfg.Proxy.ShutdownTimeout)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.Proxy.ShutdownTimeout)
+	for _, srv := range []*http.Server{server, adminServer, metricsServer, probeServer} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(drainCtx); err != nil {
+			log.WithFields(log.Fields{"addr": srv.Addr}).Warnf("abort in-flight requests, err:%v", err)
+			srv.Close()
+		}
 	}
-	log.Fatal(server.ListenAndServe())
+	if err := proxy.Shutdown(drainCtx, h); err != nil {
+		log.Warnf("shutdown background jobs failed, err:%v", err)
+	}
+	cancelDrain()
+
+	uploadCtx, cancelUploads := context.WithTimeout(context.Background(), cfg.RemoteCache.ShutdownTimeout)
+	if err := remoteCache.Close(uploadCtx); err != nil {
+		log.Errorf("close upload queue failed, err:%v", err)
+	}
+	cancelUploads()
+	if err := metaCache.Close(); err != nil {
+		log.Errorf("close meta cache failed, err:%v", err)
+	}
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), traceFlushTimeout)
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Errorf("flush traces failed, err:%v", err)
+	}
+	cancelFlush()
+	accessLog.Close()
+	log.Infof("shutdown complete")
+	os.Exit(exitCode)
+}
+
+func newHealthChecker(cfg *Config, h http.Handler, remoteCache oss.RemoteCache) (*health.Checker, error) {
+	upstream, err := proxy.NewUpstreamCheck(h)
+	if err != nil {
+		return nil, err
+	}
+	remoteLevel, upstreamLevel := health.Info, health.Info
+	if cfg.Health.RequireRemote {
+		remoteLevel = health.Ready
+	}
+	if cfg.Health.RequireUpstream {
+		upstreamLevel = health.Ready
+	}
+	checker := health.NewChecker(cfg.Health)
+	checker.Add("local_cache", health.Ready, health.DirWritable(cfg.LocalCache.CacheDir))
+	checker.Add("disk_space", health.Ready, health.FreeSpace(cfg.LocalCache.CacheDir, cfg.Health.MinFreeSpace))
+	checker.Add("remote_cache", remoteLevel, health.RemoteCache(remoteCache))
+	checker.Add("upstream", upstreamLevel, upstream)
+	checker.Add("upload_workers", health.Live, health.UploadWorkers(remoteCache, cfg.Health.UploadStallAfter))
+	return checker, nil
 }
 
 type Config struct {
 	Proxy       *proxy.ProxyConfig    `yaml:"proxy"`
+	Admin       *proxy.AdminConfig    `yaml:"admin"`
 	MetaCache   *metacache.MetaConfig `yaml:"meta_cache"`
 	LocalCache  *fs.LocalCacheConfig  `yaml:"local_cache"`
 	RemoteCache *oss.OssCacheConfig   `yaml:"remote_cache"`
+	Metrics     *metrics.Config       `yaml:"metrics"`
+	Tracing     *tracing.Config       `yaml:"tracing"`
+	AccessLog   *accesslog.Config     `yaml:"access_log"`
+	Health      *health.Config        `yaml:"health"`
 }
 
 func NewConfig() *Config {
 	return &Config{
 		Proxy:       proxy.NewConfig(),
+		Admin:       proxy.NewAdminConfig(),
 		MetaCache:   metacache.NewMetaConfig(),
 		LocalCache:  fs.NewConfig(),
 		RemoteCache: oss.NewOssCacheConfig(),
+		Metrics:     metrics.NewConfig(),
+		Tracing:     tracing.NewConfig(),
+		AccessLog:   accesslog.NewConfig(),
+		Health:      health.NewConfig(),
+	}
+}
+
+// ownersPath returns where the memory store persists blob owners. Unless
+// owners_path is set they are kept next to the local cache dir, as they must
+// outlive restarts like the blobs do, and in memory when that is not writable.
+func ownersPath(cfg *Config) string {
+	mcfg := cfg.MetaCache
+	if mcfg.OwnersPath != "" || (mcfg.Store != metacache.StoreMemory && mcfg.Store != "") || cfg.LocalCache.CacheDir == "" {
+		return mcfg.OwnersPath
+	}
+	path := filepath.Join(filepath.Dir(filepath.Clean(cfg.LocalCache.CacheDir)), "owners.db")
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.WithFields(log.Fields{"path": path}).Warnf("blob owners are kept in memory, err:%v", err)
+		return ""
 	}
+	fd.Close()
+	return path
 }
 
 func loadConfig() (*Config, error) {
@@ -0,0 +1,46 @@
+package metacache
+
+import "time"
+
+// ApiResponse is a cached hub json api response. Entries keyed by a mutable
+// revision only carry the CommitHash it resolved to.
+type ApiResponse struct {
+	CommitHash  string `json:"commit_hash,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Link        string `json:"link,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+	UpdatedAt   int64  `json:"updated_at,omitempty"`
+	// Private is set when the response could only be fetched with credentials.
+	Private bool `json:"private,omitempty"`
+}
+
+// Stale reports whether the response was fetched longer than ttl ago.
+func (a *ApiResponse) Stale(ttl time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(a.UpdatedAt, 0)) > ttl
+}
+
+func (m *metadataCache) SetApiResponse(key string, res *ApiResponse) {
+	res.UpdatedAt = time.Now().Unix()
+	m.apis.Set(key, res)
+}
+
+func (m *metadataCache) GetApiResponse(key string) *ApiResponse {
+	return m.apis.Get(key)
+}
+
+func (m *metadataCache) DeleteApiResponses(match func(key string) bool) int {
+	var keys []string
+	m.apis.Range(func(key string, res *ApiResponse) bool {
+		if match(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		m.apis.Delete(key)
+	}
+	return len(keys)
+}
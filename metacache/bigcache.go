@@ -64,3 +64,22 @@ func (l *LocalCache[T]) Delete(key string) {
 		log.Errorf("fail to delete obj from localcache, key:%v, err:%v", key, err)
 	}
 }
+
+func (l *LocalCache[T]) Range(fn func(key string, obj *T) bool) {
+	it := l.cache.Iterator()
+	for it.SetNext() {
+		entry, err := it.Value()
+		if err != nil {
+			log.Errorf("fail to iterate localcache, err:%v", err)
+			return
+		}
+		obj := new(T)
+		if err = json.Unmarshal(entry.Value(), &obj); err != nil {
+			log.Errorf("fail to unmarshal %T, key:%v, err:%v", obj, entry.Key(), err)
+			continue
+		}
+		if !fn(entry.Key(), obj) {
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package metacache
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-kratos/kratos/v2/log"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultBucket   = "metadata"
+	blobOwnerBucket = "blob_owner"
+	apiBucket       = "api"
+)
+
+var errStopRange = errors.New("stop range")
+
+// BoltCache is a disk backed key/value cache stored in a single bolt file,
+// entries never expire and survive process restarts.
+type BoltCache[T any] struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func OpenBoltDB(path string) (*bolt.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0766); err != nil {
+		return nil, err
+	}
+	return bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second * 5})
+}
+
+// NewBoltCache stores entries in bucket of db, several caches may share one db.
+func NewBoltCache[T any](db *bolt.DB, bucket string) (*BoltCache[T], error) {
+	if bucket == "" {
+		bucket = defaultBucket
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltCache[T]{
+		db:     db,
+		bucket: []byte(bucket),
+	}, nil
+}
+
+func (b *BoltCache[T]) Get(key string) (res *T) {
+	var resBytes []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(b.bucket).Get([]byte(key)); v != nil {
+			resBytes = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("fail to get object from boltcache, key:%v, err:%v", key, err)
+		return nil
+	}
+	if resBytes == nil {
+		return nil
+	}
+	res = new(T)
+	if err = json.Unmarshal(resBytes, &res); err != nil {
+		log.Errorf("fail to unmarshal %T, key:%v, err:%v", res, key, err)
+		return nil
+	}
+	return res
+}
+
+func (b *BoltCache[T]) Set(key string, obj *T) {
+	objBytes, err := json.Marshal(obj)
+	if err != nil {
+		log.Errorf("fail to marshal %T, key:%v, err:%v", obj, key, err)
+		return
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Put([]byte(key), objBytes)
+	})
+	if err != nil {
+		log.Errorf("fail to set obj to boltcache, key:%v, err:%v", key, err)
+	}
+}
+
+func (b *BoltCache[T]) Delete(key string) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Delete([]byte(key))
+	})
+	if err != nil {
+		log.Errorf("fail to delete obj from boltcache, key:%v, err:%v", key, err)
+	}
+}
+
+// Range iterates the bucket in key order, fn must not modify the cache.
+func (b *BoltCache[T]) Range(fn func(key string, obj *T) bool) {
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).ForEach(func(k, v []byte) error {
+			obj := new(T)
+			if err := json.Unmarshal(v, &obj); err != nil {
+				log.Errorf("fail to unmarshal %T, key:%s, err:%v", obj, k, err)
+				return nil
+			}
+			if !fn(string(k), obj) {
+				return errStopRange
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errStopRange {
+		log.Errorf("fail to iterate boltcache, err:%v", err)
+	}
+}
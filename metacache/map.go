@@ -0,0 +1,71 @@
+package metacache
+
+import (
+	"encoding/json"
+	"github.com/go-kratos/kratos/v2/log"
+	"sync"
+)
+
+// MapCache is an in-memory cache whose entries never expire, it grows until
+// entries are deleted.
+type MapCache[T any] struct {
+	mux   sync.RWMutex
+	items map[string][]byte
+}
+
+func NewMapCache[T any]() *MapCache[T] {
+	return &MapCache[T]{
+		items: make(map[string][]byte),
+	}
+}
+
+func (m *MapCache[T]) Get(key string) (res *T) {
+	m.mux.RLock()
+	resBytes, ok := m.items[key]
+	m.mux.RUnlock()
+	if !ok {
+		return nil
+	}
+	res = new(T)
+	if err := json.Unmarshal(resBytes, &res); err != nil {
+		log.Errorf("fail to unmarshal %T, key:%v, err:%v", res, key, err)
+		return nil
+	}
+	return res
+}
+
+func (m *MapCache[T]) Set(key string, obj *T) {
+	objBytes, err := json.Marshal(obj)
+	if err != nil {
+		log.Errorf("fail to marshal %T, key:%v, err:%v", obj, key, err)
+		return
+	}
+	m.mux.Lock()
+	m.items[key] = objBytes
+	m.mux.Unlock()
+}
+
+func (m *MapCache[T]) Delete(key string) {
+	m.mux.Lock()
+	delete(m.items, key)
+	m.mux.Unlock()
+}
+
+func (m *MapCache[T]) Range(fn func(key string, obj *T) bool) {
+	m.mux.RLock()
+	items := make(map[string][]byte, len(m.items))
+	for key, objBytes := range m.items {
+		items[key] = objBytes
+	}
+	m.mux.RUnlock()
+	for key, objBytes := range items {
+		obj := new(T)
+		if err := json.Unmarshal(objBytes, &obj); err != nil {
+			log.Errorf("fail to unmarshal %T, key:%v, err:%v", obj, key, err)
+			continue
+		}
+		if !fn(key, obj) {
+			return
+		}
+	}
+}
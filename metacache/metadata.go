@@ -3,6 +3,9 @@ package metacache
 import (
 	"fmt"
 	"github.com/allegro/bigcache"
+	bolt "go.etcd.io/bbolt"
+	"hf-mirror/metrics"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -14,19 +17,87 @@ type FileMetadata struct {
 	Etag       string `json:"etag,omitempty"`
 	Location   string `json:"location,omitempty"`
 	Size       string `json:"size,omitempty"`
+	UpdatedAt  int64  `json:"updated_at,omitempty"`
+	// Gated is set when the file could only be resolved with credentials.
+	Gated bool `json:"gated,omitempty"`
+	// Project and File are the repo file the metadata was resolved for.
+	Project string `json:"project,omitempty"`
+	File    string `json:"file,omitempty"`
+}
+
+// BlobOwner records which repo file a blob belongs to, so that requesters can be
+// authorised against it before the blob is served from cache. Public is set for
+// blobs that were resolved anonymously, records without it are gated.
+type BlobOwner struct {
+	RepoType string `json:"repo_type,omitempty"`
+	Project  string `json:"project"`
+	File     string `json:"file"`
+	Revision string `json:"revision"`
+	Public   bool   `json:"public,omitempty"`
+}
+
+var commitHashReg = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// IsCommitHash reports whether revision is a full commit hash, metadata resolved
+// by commit hash is immutable while branches and tags may move.
+func IsCommitHash(revision string) bool {
+	return commitHashReg.MatchString(revision)
+}
+
+// Stale reports whether the metadata was resolved longer than ttl ago.
+func (f *FileMetadata) Stale(ttl time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(f.UpdatedAt, 0)) > ttl
 }
 
 type metadataCache struct {
 	mux   sync.RWMutex
-	cache *LocalCache[[]*FileMetadata]
+	cache Cache[[]*FileMetadata]
+	// pinned keeps the metadata resolved by commit hash of the memory store,
+	// it is immutable and must not expire with the other entries.
+	pinned Cache[[]*FileMetadata]
+	owners Cache[BlobOwner]
+	apis   Cache[ApiResponse]
+	dbs    []*bolt.DB
 }
 
 type MetaDataCache interface {
 	AppendMetadata(project, file string, meta *FileMetadata)
 	SearchMetaData(project, file string, revision string) *FileMetadata
+	// RangeMetadata calls fn with the metadata of every cached repo file until fn returns false.
+	RangeMetadata(fn func(project, file string, metas []*FileMetadata) bool)
+	// DeleteMetadata removes the metadata of project resolved for revision, a
+	// tag or a full commit hash, and returns the number of removed entries.
+	DeleteMetadata(project, revision string) int
+	SetBlobOwner(etag string, owner *BlobOwner)
+	GetBlobOwner(etag string) *BlobOwner
+	SetApiResponse(key string, res *ApiResponse)
+	GetApiResponse(key string) *ApiResponse
+	// DeleteApiResponses removes the cached api responses whose key matches, it returns their number.
+	DeleteApiResponses(match func(key string) bool) int
+	// Close closes the bolt files of the cache, if any.
+	Close() error
 }
 
+const (
+	StoreMemory = "memory"
+	StoreBolt   = "bolt"
+)
+
 type MetaConfig struct {
+	// Store selects the backing store, "memory" keeps metadata in bigcache only,
+	// "bolt" persists it to Path with bigcache as the in-memory front tier.
+	// Metadata resolved by commit hash never expires, the memory store keeps it
+	// outside of bigcache until it is deleted.
+	Store string `yaml:"store"`
+	Path  string `yaml:"path"`
+	// OwnersPath persists the blob owners of the memory store, they must outlive
+	// the metadata as blobs stay cached after it expired. Empty keeps them in memory,
+	// blobs whose owner is unknown are never served from cache. The server defaults
+	// it to owners.db next to the local cache dir.
+	OwnersPath         string        `yaml:"owners_path"`
 	Shards             int           `yaml:"shards"`
 	LifeWindow         time.Duration `yaml:"life_window"`
 	CleanWindow        time.Duration `yaml:"clean_window"`
@@ -36,6 +107,8 @@ type MetaConfig struct {
 
 func NewMetaConfig() *MetaConfig {
 	return &MetaConfig{
+		Store:              StoreMemory,
+		Path:               "/hf-mirror/meta/metadata.db",
 		Shards:             1024,
 		LifeWindow:         time.Hour * 24,
 		CleanWindow:        time.Second * 10,
@@ -45,30 +118,91 @@ func NewMetaConfig() *MetaConfig {
 }
 
 func NewMetaDataCache(cfg *MetaConfig) MetaDataCache {
-	c, err := NewLocalCache[[]*FileMetadata](&bigcache.Config{
+	bcfg := &bigcache.Config{
 		Shards:             cfg.Shards,
 		LifeWindow:         cfg.LifeWindow,
 		CleanWindow:        cfg.CleanWindow,
 		MaxEntriesInWindow: cfg.MaxEntriesInWindow,
 		MaxEntrySize:       cfg.MaxEntrySize,
-	})
+	}
+	var db, ownersDb *bolt.DB
+	var err error
+	switch cfg.Store {
+	case StoreBolt:
+		if db, err = OpenBoltDB(cfg.Path); err != nil {
+			panic(err)
+		}
+		ownersDb = db
+	case StoreMemory, "":
+		if cfg.OwnersPath != "" {
+			if ownersDb, err = OpenBoltDB(cfg.OwnersPath); err != nil {
+				panic(err)
+			}
+		}
+	default:
+		panic(fmt.Sprintf("unknown meta cache store: %v", cfg.Store))
+	}
+	m := &metadataCache{
+		cache:  newCache[[]*FileMetadata](bcfg, db, defaultBucket),
+		owners: newCache[BlobOwner](bcfg, ownersDb, blobOwnerBucket),
+		apis:   newCache[ApiResponse](bcfg, db, apiBucket),
+	}
+	if db == nil {
+		m.pinned = NewMapCache[[]*FileMetadata]()
+	}
+	if ownersDb != nil {
+		m.dbs = append(m.dbs, ownersDb)
+	}
+	if db != nil && db != ownersDb {
+		m.dbs = append(m.dbs, db)
+	}
+	return m
+}
+
+// newCache returns a bigcache backed cache, fronting a bolt bucket when db is set.
+func newCache[T any](cfg *bigcache.Config, db *bolt.DB, bucket string) Cache[T] {
+	c, err := NewLocalCache[T](cfg)
 	if err != nil {
 		panic(err)
 	}
-	return &metadataCache{
-		cache: c,
+	if db == nil {
+		return c
 	}
+	bc, err := NewBoltCache[T](db, bucket)
+	if err != nil {
+		panic(err)
+	}
+	return NewTieredCache[T](c, bc)
 }
 
 func getMetaKey(project, file string) string {
 	return fmt.Sprintf("%v_%v", project, file)
 }
 
+// storeFor returns the cache metadata resolved for revision is kept in.
+func (m *metadataCache) storeFor(revision string) Cache[[]*FileMetadata] {
+	if m.pinned != nil && IsCommitHash(revision) {
+		return m.pinned
+	}
+	return m.cache
+}
+
+func (m *metadataCache) stores() []Cache[[]*FileMetadata] {
+	if m.pinned != nil {
+		return []Cache[[]*FileMetadata]{m.cache, m.pinned}
+	}
+	return []Cache[[]*FileMetadata]{m.cache}
+}
+
 func (m *metadataCache) AppendMetadata(project, file string, meta *FileMetadata) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
 	key := getMetaKey(project, file)
-	metasPt := m.cache.Get(key)
+	meta.UpdatedAt = time.Now().Unix()
+	meta.Project = project
+	meta.File = file
+	store := m.storeFor(meta.Tag)
+	metasPt := store.Get(key)
 	var metas []*FileMetadata
 	if metasPt != nil {
 		metas = *metasPt
@@ -84,26 +218,111 @@ func (m *metadataCache) AppendMetadata(project, file string, meta *FileMetadata)
 	if !found {
 		metas = append(metas, meta)
 	}
-	m.cache.Set(key, &metas)
+	store.Set(key, &metas)
 }
 
 func (m *metadataCache) SearchMetaData(project, file string, revision string) *FileMetadata {
 	key := getMetaKey(project, file)
 	m.mux.RLock()
-	metasPt := m.cache.Get(key)
-	m.mux.RUnlock()
-
-	var metas []*FileMetadata
-	if metasPt != nil {
-		metas = *metasPt
+	defer m.mux.RUnlock()
+	for _, store := range m.stores() {
+		metasPt := store.Get(key)
+		if metasPt == nil {
+			continue
+		}
+		for _, meta := range *metasPt {
+			if meta.Tag == revision || strings.HasPrefix(meta.CommitHash, revision) {
+				metrics.Hit("file", true)
+				return meta
+			}
+		}
 	}
+	metrics.Hit("file", false)
+	return nil
+}
+
+// splitMetaKey recovers project and file of a meta key, entries stored before
+// FileMetadata carried them are split at the first "_" on a best effort basis.
+func splitMetaKey(key string, metas []*FileMetadata) (project, file string) {
 	for _, meta := range metas {
-		if meta.Tag == revision {
-			return meta
+		if meta.Project != "" {
+			return meta.Project, meta.File
 		}
-		if strings.HasPrefix(meta.CommitHash, revision) {
-			return meta
+	}
+	project, file, _ = strings.Cut(key, "_")
+	return project, file
+}
+
+func (m *metadataCache) RangeMetadata(fn func(project, file string, metas []*FileMetadata) bool) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	stopped := false
+	for _, store := range m.stores() {
+		store.Range(func(key string, metas *[]*FileMetadata) bool {
+			project, file := splitMetaKey(key, *metas)
+			stopped = !fn(project, file, *metas)
+			return !stopped
+		})
+		if stopped {
+			return
 		}
 	}
-	return nil
+}
+
+func (m *metadataCache) DeleteMetadata(project, revision string) int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	removed := 0
+	for _, store := range m.stores() {
+		removed += deleteMetadata(store, project, revision)
+	}
+	return removed
+}
+
+func deleteMetadata(store Cache[[]*FileMetadata], project, revision string) int {
+	updates := make(map[string][]*FileMetadata)
+	removed := 0
+	store.Range(func(key string, metas *[]*FileMetadata) bool {
+		if p, _ := splitMetaKey(key, *metas); p != project {
+			return true
+		}
+		var kept []*FileMetadata
+		for _, meta := range *metas {
+			if meta.Tag != revision && meta.CommitHash != revision {
+				kept = append(kept, meta)
+			}
+		}
+		if len(kept) != len(*metas) {
+			updates[key] = kept
+			removed += len(*metas) - len(kept)
+		}
+		return true
+	})
+	// bolt does not allow writes while ranging
+	for key, kept := range updates {
+		if len(kept) == 0 {
+			store.Delete(key)
+		} else {
+			store.Set(key, &kept)
+		}
+	}
+	return removed
+}
+
+func (m *metadataCache) SetBlobOwner(etag string, owner *BlobOwner) {
+	m.owners.Set(etag, owner)
+}
+
+func (m *metadataCache) GetBlobOwner(etag string) *BlobOwner {
+	return m.owners.Get(etag)
+}
+
+func (m *metadataCache) Close() error {
+	var res error
+	for _, db := range m.dbs {
+		if err := db.Close(); err != nil && res == nil {
+			res = fmt.Errorf("failed to close %v, %v", db.Path(), err)
+		}
+	}
+	return res
 }
@@ -0,0 +1,117 @@
+package metacache
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestConfig(t *testing.T) *MetaConfig {
+	cfg := NewMetaConfig()
+	cfg.Shards = 16
+	cfg.LifeWindow = time.Second
+	cfg.CleanWindow = time.Second
+	cfg.OwnersPath = filepath.Join(t.TempDir(), "owners.db")
+	return cfg
+}
+
+func TestBlobOwnerOutlivesMetadata(t *testing.T) {
+	cfg := newTestConfig(t)
+	m := NewMetaDataCache(cfg)
+	defer m.Close()
+
+	m.AppendMetadata("models/org/gated", "model.bin", &FileMetadata{Tag: "main", Etag: "abc", Gated: true})
+	m.SetBlobOwner("abc", &BlobOwner{Project: "org/gated", File: "model.bin", Revision: "main"})
+
+	deadline := time.Now().Add(time.Second * 10)
+	for m.SearchMetaData("models/org/gated", "model.bin", "main") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("metadata did not expire")
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+	owner := m.GetBlobOwner("abc")
+	if owner == nil {
+		t.Fatal("blob owner expired with the metadata")
+	}
+	if owner.Public || owner.Project != "org/gated" {
+		t.Fatalf("unexpected owner %+v", owner)
+	}
+}
+
+func TestCommitMetadataNeverExpires(t *testing.T) {
+	m := NewMetaDataCache(newTestConfig(t))
+	defer m.Close()
+	hash := "0123456789abcdef0123456789abcdef01234567"
+	m.AppendMetadata("models/org/model", "config.json", &FileMetadata{Tag: "main", CommitHash: hash, Etag: "abc"})
+	m.AppendMetadata("models/org/model", "config.json", &FileMetadata{Tag: hash, CommitHash: hash, Etag: "abc"})
+
+	deadline := time.Now().Add(time.Second * 10)
+	for m.SearchMetaData("models/org/model", "config.json", "main") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("metadata of the branch did not expire")
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+	if meta := m.SearchMetaData("models/org/model", "config.json", hash); meta == nil || meta.Tag != hash {
+		t.Fatalf("metadata pinned to the commit expired, got %+v", meta)
+	}
+	var files int
+	m.RangeMetadata(func(project, file string, metas []*FileMetadata) bool {
+		files += len(metas)
+		return true
+	})
+	if files != 1 {
+		t.Errorf("ranged %d entries, want the pinned one", files)
+	}
+	if removed := m.DeleteMetadata("models/org/model", hash); removed != 1 {
+		t.Errorf("removed %d entries", removed)
+	}
+	if meta := m.SearchMetaData("models/org/model", "config.json", hash); meta != nil {
+		t.Errorf("deleted metadata still cached %+v", meta)
+	}
+}
+
+func TestBlobOwnerSurvivesRestart(t *testing.T) {
+	for _, store := range []string{StoreMemory, StoreBolt} {
+		t.Run(store, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.Store = store
+			cfg.Path = filepath.Join(t.TempDir(), "metadata.db")
+			m := NewMetaDataCache(cfg)
+			m.SetBlobOwner("gated", &BlobOwner{Project: "org/gated", File: "model.bin", Revision: "main"})
+			m.SetBlobOwner("public", &BlobOwner{Project: "org/public", File: "model.bin", Revision: "main", Public: true})
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			m = NewMetaDataCache(cfg)
+			defer m.Close()
+			if owner := m.GetBlobOwner("gated"); owner == nil || owner.Public {
+				t.Fatalf("gated owner lost on restart: %+v", owner)
+			}
+			if owner := m.GetBlobOwner("public"); owner == nil || !owner.Public {
+				t.Fatalf("public owner lost on restart: %+v", owner)
+			}
+		})
+	}
+}
+
+func TestBlobOwnerWithoutOwnersPath(t *testing.T) {
+	cfg := newTestConfig(t)
+	// the default opens no bolt file, which may not be writable
+	cfg.OwnersPath = NewMetaConfig().OwnersPath
+	if cfg.OwnersPath != "" {
+		t.Fatalf("owners path defaults to %v", cfg.OwnersPath)
+	}
+	m := NewMetaDataCache(cfg)
+	m.SetBlobOwner("abc", &BlobOwner{Project: "org/gated"})
+	m.Close()
+
+	// a new process knows nothing about the blob, the proxy must not take that as public
+	m = NewMetaDataCache(cfg)
+	defer m.Close()
+	if owner := m.GetBlobOwner("abc"); owner != nil {
+		t.Fatalf("unexpected owner %+v", owner)
+	}
+}
@@ -0,0 +1,50 @@
+package metacache
+
+// Cache is the key/value contract shared by the in-memory and disk backed caches.
+type Cache[T any] interface {
+	Get(key string) *T
+	Set(key string, obj *T)
+	Delete(key string)
+	// Range calls fn for every entry until fn returns false.
+	Range(fn func(key string, obj *T) bool)
+}
+
+// TieredCache serves reads from the front cache and falls back to the back
+// cache on a miss, warming the front cache with what it found.
+type TieredCache[T any] struct {
+	front Cache[T]
+	back  Cache[T]
+}
+
+func NewTieredCache[T any](front, back Cache[T]) *TieredCache[T] {
+	return &TieredCache[T]{
+		front: front,
+		back:  back,
+	}
+}
+
+func (t *TieredCache[T]) Get(key string) *T {
+	if res := t.front.Get(key); res != nil {
+		return res
+	}
+	res := t.back.Get(key)
+	if res != nil {
+		t.front.Set(key, res)
+	}
+	return res
+}
+
+func (t *TieredCache[T]) Set(key string, obj *T) {
+	t.back.Set(key, obj)
+	t.front.Set(key, obj)
+}
+
+func (t *TieredCache[T]) Delete(key string) {
+	t.back.Delete(key)
+	t.front.Delete(key)
+}
+
+// Range iterates the back cache, it holds every entry of the front cache.
+func (t *TieredCache[T]) Range(fn func(key string, obj *T) bool) {
+	t.back.Range(fn)
+}
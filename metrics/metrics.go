@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+)
+
+const namespace = "hf_mirror"
+
+// Tiers a blob download can be served from, TierMeta only answers metadata and api calls.
+const (
+	TierMeta     = "meta"
+	TierLocal    = "local"
+	TierRemote   = "remote"
+	TierUpstream = "upstream"
+)
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Addr is the listener of the metrics, separate from the proxy listener so
+	// that they are not exposed to the clients of the mirror.
+	Addr string `yaml:"addr"`
+	// Path is where the metrics listener serves the metrics.
+	Path string `yaml:"path"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Enabled: true,
+		Addr:    "0.0.0.0:9091",
+		Path:    "/metrics",
+	}
+}
+
+var (
+	MetaCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "meta_cache_requests_total",
+		Help:      "Lookups of file metadata and api responses in the meta cache.",
+	}, []string{"kind", "result"})
+
+	BlobRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blob_requests_total",
+		Help:      "Blob downloads by the tier that served them.",
+	}, []string{"tier"})
+
+	BlobBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blob_served_bytes_total",
+		Help:      "Bytes of blobs served by the tier that served them.",
+	}, []string{"tier"})
+
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Time until the response headers of upstream requests arrived.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"client", "method", "code"})
+
+	RemoteUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "remote_uploads_total",
+		Help:      "Upload attempts of blobs to the remote cache.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(MetaCacheRequests, BlobRequests, BlobBytes, UpstreamDuration, RemoteUploads)
+}
+
+// Hit counts a meta cache lookup of kind.
+func Hit(kind string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	MetaCacheRequests.WithLabelValues(kind, result).Inc()
+}
+
+// GaugeFunc exports the value of fn, only the first registration of a name is kept.
+func GaugeFunc(name, help string, fn func() float64) {
+	register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: namespace, Name: name, Help: help}, fn))
+}
+
+// CounterFunc exports the value of fn, which must only ever increase.
+func CounterFunc(name, help string, fn func() float64) {
+	register(prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: namespace, Name: name, Help: help}, fn))
+}
+
+func register(c prometheus.Collector) {
+	if err := prometheus.Register(c); err != nil {
+		var already prometheus.AlreadyRegisteredError
+		if !errors.As(err, &already) {
+			log.Errorf("register metric failed, err:%v", err)
+		}
+	}
+}
+
+// InstrumentTransport observes the latency of requests sent through rt as client.
+func InstrumentTransport(client string, rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return promhttp.InstrumentRoundTripperDuration(UpstreamDuration.MustCurryWith(prometheus.Labels{"client": client}), rt)
+}
+
+type blobWriter struct {
+	http.ResponseWriter
+	bytes prometheus.Counter
+}
+
+// ServeBlob counts a blob download served by tier, the bytes written to the
+// returned writer are counted as served by tier.
+func ServeBlob(rw http.ResponseWriter, tier string) http.ResponseWriter {
+	BlobRequests.WithLabelValues(tier).Inc()
+	return &blobWriter{ResponseWriter: rw, bytes: BlobBytes.WithLabelValues(tier)}
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes.Add(float64(n))
+	return n, err
+}
+
+// ReadFrom keeps the sendfile path of the wrapped writer, which local blobs are served with.
+func (w *blobWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.bytes.Add(float64(n))
+	return n, err
+}
+
+func (w *blobWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *blobWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Handler serves the metrics at the path of cfg on the metrics listener.
+func Handler(cfg *Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, promhttp.Handler())
+	return mux
+}
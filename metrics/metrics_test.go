@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"hf-mirror/internal/writertest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServeBlobKeepsReadFrom(t *testing.T) {
+	before := testutil.ToFloat64(BlobBytes.WithLabelValues(TierLocal))
+	writertest.CopyThrough(t, func(w http.ResponseWriter) http.ResponseWriter {
+		return ServeBlob(w, TierLocal)
+	})
+	if got := testutil.ToFloat64(BlobBytes.WithLabelValues(TierLocal)) - before; got != float64(len(writertest.Body)) {
+		t.Errorf("counted %v bytes, want %v", got, len(writertest.Body))
+	}
+}
+
+func TestHandlerServesOnlyMetrics(t *testing.T) {
+	h := Handler(NewConfig())
+	for path, code := range map[string]int{"/metrics": http.StatusOK, "/gpt2/resolve/main/config.json": http.StatusNotFound} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		if rw.Code != code {
+			t.Errorf("%v: status %v, want %v", path, rw.Code, code)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package oss
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
@@ -9,43 +12,94 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	log "github.com/sirupsen/logrus"
+	"hf-mirror/tracing"
+	"hf-mirror/units"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"time"
 )
 
 type Config struct {
+	// Endpoint of an S3 compatible store, its scheme decides whether TLS is used.
+	// Empty means AWS proper, resolved from Region.
 	Endpoint string `yaml:"endpoint"`
 	Region   string `yaml:"region"`
-	Ak       string `yaml:"ak"`
-	Sk       string `yaml:"sk"`
-	Bucket   string `yaml:"bucket"`
+	// Ak and Sk are static credentials, when both are empty the standard AWS
+	// chain is used: env, shared config Profile, web identity and instance roles.
+	Ak      string `yaml:"ak"`
+	Sk      string `yaml:"sk"`
+	Profile string `yaml:"profile"`
+	Bucket  string `yaml:"bucket"`
+	// PathStyle addresses buckets as endpoint/bucket instead of bucket.endpoint.
+	PathStyle bool `yaml:"path_style"`
+	// CaBundle is a PEM file of the CAs trusted instead of the system ones,
+	// it takes precedence over AWS_CA_BUNDLE.
+	CaBundle           string `yaml:"ca_bundle"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// MultipartThreshold is the file size above which uploads are split into parts.
+	MultipartThreshold units.ByteSize `yaml:"multipart_threshold"`
+	// PartSize is the size of each part, at least 5MiB, it grows for files that would need more than 10000 parts.
+	PartSize units.ByteSize `yaml:"part_size"`
+	// PartConcurrent is how many parts of one file are uploaded at once, each buffers a part in memory.
+	PartConcurrent int `yaml:"part_concurrent"`
 }
 
-func newSession(cfg *Config) *session.Session {
-	sess := session.Must(session.NewSession(&aws.Config{
-		DisableSSL:                aws.Bool(true),
-		Endpoint:                  aws.String(cfg.Endpoint),
-		Region:                    aws.String(cfg.Region),
+func newSession(cfg *Config) (*session.Session, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	awsConfig := aws.Config{
+		HTTPClient:                &http.Client{Transport: transport},
 		DisableEndpointHostPrefix: aws.Bool(true),
 		DisableComputeChecksums:   aws.Bool(true),
-		S3ForcePathStyle:          aws.Bool(true),
+		S3ForcePathStyle:          aws.Bool(cfg.PathStyle),
 		S3Disable100Continue:      aws.Bool(true),
-		Credentials: credentials.NewStaticCredentials(
-			cfg.Ak,
-			cfg.Sk,
-			"", // <yourToken>，可以不填。
-		),
-	}))
-	return sess
+	}
+	if cfg.Region != "" {
+		awsConfig.Region = aws.String(cfg.Region)
+	}
+	if cfg.Endpoint != "" {
+		endpoint, err := url.Parse(cfg.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 endpoint %v, %v", cfg.Endpoint, err)
+		}
+		awsConfig.Endpoint = aws.String(cfg.Endpoint)
+		awsConfig.DisableSSL = aws.Bool(endpoint.Scheme == "http")
+	}
+	if cfg.Ak != "" || cfg.Sk != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(cfg.Ak, cfg.Sk, "")
+	}
+	opts := session.Options{
+		Config:            awsConfig,
+		Profile:           cfg.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if cfg.CaBundle != "" {
+		pemCerts, err := os.ReadFile(cfg.CaBundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca bundle %v, %v", cfg.CaBundle, err)
+		}
+		opts.CustomCABundle = bytes.NewReader(pemCerts)
+	}
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	// traced only now, the session installs custom CAs on the plain transport
+	sess.Config.HTTPClient.Transport = tracing.Transport("s3", sess.Config.HTTPClient.Transport)
+	return sess, nil
 }
 
-func NewS3Client(cfg *Config) *S3 {
-	sess := newSession(cfg)
+func NewS3Client(cfg *Config) (*S3, error) {
+	sess, err := newSession(cfg)
+	if err != nil {
+		return nil, err
+	}
 	return &S3{
 		client: s3.New(sess),
 		cfg:    cfg,
-	}
+	}, nil
 }
 
 type S3 struct {
@@ -68,7 +122,18 @@ func fileMd5(localFile string) (string, error) {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
 }
 
-func (s *S3) UploadFile(localFile, remoteFile string) error {
+func (s *S3) UploadFile(ctx context.Context, localFile, remoteFile string) error {
+	info, err := os.Stat(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat file %v, %v", localFile, err)
+	}
+	if info.Size() > int64(s.cfg.MultipartThreshold) {
+		return s.uploadMultipart(ctx, localFile, remoteFile, info.Size())
+	}
+	return s.putObject(ctx, localFile, remoteFile)
+}
+
+func (s *S3) putObject(ctx context.Context, localFile, remoteFile string) error {
 	fp, err := os.Open(localFile)
 	if err != nil {
 		return fmt.Errorf("failed to open file %v, %v", localFile, err)
@@ -79,7 +144,7 @@ func (s *S3) UploadFile(localFile, remoteFile string) error {
 	if err != nil {
 		return err
 	}
-	result, err := s.client.PutObject(&s3.PutObjectInput{
+	result, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
 		Body:       aws.ReadSeekCloser(fp),
 		Bucket:     aws.String(s.cfg.Bucket),
 		Key:        aws.String(remoteFile),
@@ -94,11 +159,81 @@ func (s *S3) UploadFile(localFile, remoteFile string) error {
 }
 
 func (s *S3) GetRequest(remoteFile string) (string, error) {
-	return url.JoinPath(s.cfg.Endpoint, s.cfg.Bucket, remoteFile)
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.cfg.Bucket),
+		Key:    aws.String(remoteFile),
+	})
+	if err := req.Build(); err != nil {
+		return "", err
+	}
+	return req.HTTPRequest.URL.String(), nil
+}
+
+// Presign returns a GET url of remoteFile that is valid without credentials until expire passes.
+func (s *S3) Presign(remoteFile string, expire time.Duration) (string, error) {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.cfg.Bucket),
+		Key:    aws.String(remoteFile),
+	})
+	return req.Presign(expire)
+}
+
+// Download opens remoteFile, rng is an optional http Range header value.
+func (s *S3) Download(ctx context.Context, remoteFile, rng string) (*RemoteObject, error) {
+	in := &s3.GetObjectInput{
+		Bucket: aws.String(s.cfg.Bucket),
+		Key:    aws.String(remoteFile),
+	}
+	if rng != "" {
+		in.Range = aws.String(rng)
+	}
+	out, err := s.client.GetObjectWithContext(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file %v, %v", remoteFile, err)
+	}
+	return &RemoteObject{
+		Body:          out.Body,
+		ContentLength: aws.Int64Value(out.ContentLength),
+		ContentRange:  aws.StringValue(out.ContentRange),
+	}, nil
+}
+
+// ListFiles returns the keys of the bucket under prefix.
+func (s *S3) ListFiles(prefix string) (map[string]bool, error) {
+	files := make(map[string]bool)
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.cfg.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			files[aws.StringValue(obj.Key)] = true
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files of %v, %v", prefix, err)
+	}
+	return files, nil
+}
+
+func (s *S3) DeleteFile(remoteFile string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.cfg.Bucket),
+		Key:    aws.String(remoteFile),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete file %v, %v", remoteFile, err)
+	}
+	return nil
+}
+
+func (s *S3) Ping(ctx context.Context) error {
+	_, err := s.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.cfg.Bucket)})
+	return err
 }
 
-func (s *S3) StatFile(remoteFile string) error {
-	_, err := s.client.HeadObject(&s3.HeadObjectInput{
+func (s *S3) StatFile(ctx context.Context, remoteFile string) error {
+	_, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.cfg.Bucket),
 		Key:    aws.String(remoteFile),
 	})
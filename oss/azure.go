@@ -0,0 +1,200 @@
+package oss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"hf-mirror/fs"
+	"hf-mirror/units"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// AzureConfig stores blobs in an Azure Blob Storage container, requests are
+// authorised with the account Key (SharedKey) or a Sas token.
+type AzureConfig struct {
+	// Endpoint defaults to https://{account}.blob.core.windows.net, for Azurite
+	// it is the account url like http://127.0.0.1:10000/devstoreaccount1.
+	Endpoint string `yaml:"endpoint"`
+	Account  string `yaml:"account"`
+	// Key is the base64 account key, it is also needed to presign urls.
+	Key string `yaml:"key"`
+	// Sas is a SAS token used instead of Key, without the leading "?". Downloads
+	// are streamed instead of redirected with it.
+	Sas       string `yaml:"sas"`
+	Container string `yaml:"container"`
+	// BlockSize is the size of the blocks blobs are uploaded in.
+	BlockSize units.ByteSize `yaml:"block_size"`
+}
+
+type azureBackend struct {
+	cfg          *AzureConfig
+	containerUrl string
+	client       *container.Client
+}
+
+func newAzureBackend(cfg *OssCacheConfig) (Backend, error) {
+	acfg := cfg.Azure
+	if acfg == nil || acfg.Account == "" || acfg.Container == "" {
+		return nil, fmt.Errorf("remote cache azure account and container are not configured")
+	}
+	if acfg.Key == "" && acfg.Sas == "" {
+		return nil, fmt.Errorf("remote cache azure needs a key or sas token")
+	}
+	endpoint := acfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + acfg.Account + ".blob.core.windows.net"
+	}
+	a := &azureBackend{
+		cfg:          acfg,
+		containerUrl: strings.TrimSuffix(endpoint, "/") + "/" + acfg.Container,
+	}
+	opts := &container.ClientOptions{}
+	opts.Transport = &http.Client{Transport: newBucketTransport("azure")}
+	var err error
+	if acfg.Key != "" {
+		var cred *container.SharedKeyCredential
+		if cred, err = container.NewSharedKeyCredential(acfg.Account, acfg.Key); err != nil {
+			return nil, fmt.Errorf("invalid azure account key, %v", err)
+		}
+		a.client, err = container.NewClientWithSharedKeyCredential(a.containerUrl, cred, opts)
+	} else {
+		a.client, err = container.NewClientWithNoCredential(a.containerUrl+"?"+strings.TrimPrefix(acfg.Sas, "?"), opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create azure client, %v", err)
+	}
+	return a, nil
+}
+
+func isAzureNotFound(err error) bool {
+	var resErr *azcore.ResponseError
+	return errors.As(err, &resErr) && resErr.StatusCode == http.StatusNotFound
+}
+
+// UploadFile uploads localFile in blocks, each checked by its crc64, and commits the block list.
+func (a *azureBackend) UploadFile(ctx context.Context, localFile, key string) error {
+	fp, err := os.Open(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to open file %v, %v", localFile, err)
+	}
+	defer fp.Close()
+	_, err = a.client.NewBlockBlobClient(key).UploadFile(ctx, fp, &blockblob.UploadFileOptions{
+		BlockSize:               int64(a.cfg.BlockSize),
+		TransactionalValidation: blob.TransferValidationTypeComputeCRC64(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload file %v, %v", localFile, err)
+	}
+	return nil
+}
+
+func (a *azureBackend) StatFile(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, bucketTimeout)
+	defer cancel()
+	_, err := a.client.NewBlobClient(key).GetProperties(ctx, nil)
+	if isAzureNotFound(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %v, %v", key, err)
+	}
+	return nil
+}
+
+func (a *azureBackend) DeleteFile(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bucketTimeout)
+	defer cancel()
+	_, err := a.client.NewBlobClient(key).Delete(ctx, nil)
+	if err != nil && !isAzureNotFound(err) {
+		return fmt.Errorf("failed to delete %v, %v", key, err)
+	}
+	return nil
+}
+
+func (a *azureBackend) Download(ctx context.Context, key, rng string) (*RemoteObject, error) {
+	b := a.client.NewBlobClient(key)
+	opts := &blob.DownloadStreamOptions{}
+	if rng != "" {
+		offset, length, err := parseByteRange(rng)
+		if err != nil {
+			return nil, err
+		}
+		if offset < 0 {
+			// a suffix range, azure only takes ranges from an offset
+			props, err := b.GetProperties(ctx, nil)
+			if isAzureNotFound(err) {
+				return nil, ErrNotFound
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to download %v, %v", key, err)
+			}
+			r, ok := fs.ParseRange(rng, *props.ContentLength)
+			if !ok {
+				return nil, fmt.Errorf("invalid range %v of %v", rng, key)
+			}
+			offset, length = r.Start, r.End-r.Start
+		}
+		opts.Range = blob.HTTPRange{Offset: offset}
+		if length > 0 {
+			opts.Range.Count = length
+		}
+	}
+	res, err := b.DownloadStream(ctx, opts)
+	if isAzureNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %v, %v", key, err)
+	}
+	obj := &RemoteObject{Body: res.Body}
+	if res.ContentLength != nil {
+		obj.ContentLength = *res.ContentLength
+	}
+	if rng != "" && res.ContentRange != nil {
+		obj.ContentRange = *res.ContentRange
+	}
+	return obj, nil
+}
+
+func (a *azureBackend) ListFiles(prefix string) (map[string]bool, error) {
+	files := make(map[string]bool)
+	pager := a.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix})
+	for pager.More() {
+		ctx, cancel := context.WithTimeout(context.Background(), bucketTimeout)
+		page, err := pager.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files of %v, %v", prefix, err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			files[*item.Name] = true
+		}
+	}
+	return files, nil
+}
+
+func (a *azureBackend) GetRequest(key string) (string, error) {
+	return a.containerUrl + "/" + escapeKey(key), nil
+}
+
+// Presign returns the blob url with a read only service SAS of the blob. It
+// needs the account key, the configured sas token is never handed out as it
+// may grant more than reading the blob and outlive expire.
+func (a *azureBackend) Presign(key string, expire time.Duration) (string, error) {
+	if a.cfg.Key == "" {
+		return "", ErrNotSupported
+	}
+	return a.client.NewBlobClient(key).GetSASURL(sas.BlobPermissions{Read: true}, timeNow().Add(expire), nil)
+}
+
+func init() {
+	RegisterBackend(BackendAzure, newAzureBackend)
+}
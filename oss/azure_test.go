@@ -0,0 +1,78 @@
+package oss
+
+import (
+	"context"
+	"errors"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// the well known Azurite account
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+func newTestAzureBackend(t *testing.T, acfg *AzureConfig) *azureBackend {
+	b, err := newBackend(&OssCacheConfig{Type: BackendAzure, Azure: acfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*azureBackend)
+}
+
+// fixTimeNow freezes the clock of the signatures for the test.
+func fixTimeNow(t *testing.T, now time.Time) {
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+}
+
+func TestAzurePresign(t *testing.T) {
+	fixTimeNow(t, time.Date(2026, 10, 17, 4, 0, 0, 0, time.UTC))
+	a := newTestAzureBackend(t, &AzureConfig{Account: azuriteAccount, Key: azuriteKey, Container: "c"})
+	presigned, err := a.Presign("huggingface/blobs/abc", time.Minute*15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Host != azuriteAccount+".blob.core.windows.net" || u.Path != "/c/huggingface/blobs/abc" {
+		t.Errorf("unexpected presigned url %v", presigned)
+	}
+	if query.Get("se") != "2026-10-17T04:15:00Z" || query.Get("sp") != "r" || query.Get("sr") != "b" || query.Get("sig") == "" {
+		t.Errorf("unexpected sas of presigned url %v", presigned)
+	}
+}
+
+func TestAzurePresignWithoutKey(t *testing.T) {
+	a := newTestAzureBackend(t, &AzureConfig{Account: azuriteAccount, Sas: "sv=2020-12-06&sp=rwdl&sig=secret", Container: "c"})
+	if presigned, err := a.Presign("huggingface/blobs/abc", time.Minute); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("presign with a sas token returned %q, %v", presigned, err)
+	}
+}
+
+// TestAzureBackend runs against Azurite, started with e.g.
+// AZURITE_BLOB_ENDPOINT=http://127.0.0.1:10000/devstoreaccount1
+func TestAzureBackend(t *testing.T) {
+	endpoint := os.Getenv("AZURITE_BLOB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("AZURITE_BLOB_ENDPOINT is not set")
+	}
+	a := newTestAzureBackend(t, &AzureConfig{
+		Endpoint:  endpoint,
+		Account:   azuriteAccount,
+		Key:       azuriteKey,
+		Container: "hf-mirror-test",
+		BlockSize: 64 << 10,
+	})
+	if _, err := a.client.Create(context.Background(), nil); err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		t.Fatalf("failed to create container, %v", err)
+	}
+	testBackend(t, a, 200<<10)
+}
@@ -0,0 +1,144 @@
+package oss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hf-mirror/tracing"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BackendS3    = "s3"
+	BackendPosix = "posix"
+	BackendAzure = "azure"
+	BackendGcs   = "gcs"
+)
+
+var (
+	ErrNotSupported = errors.New("not supported by the storage backend")
+	ErrNotFound     = errors.New("file not found in the storage backend")
+)
+
+// bucketTimeout bounds the bucket calls of the gcs and azure backends that do
+// not stream a blob, the streaming ones give up when no response header
+// arrives within it. Tests shorten it.
+var bucketTimeout = time.Minute
+
+// timeNow is the clock of presigned urls, tests replace it to sign deterministic urls.
+var timeNow = time.Now
+
+// Backend is the object storage the remote cache keeps blobs in, keys are
+// the blob dir joined with the blob's etag.
+type Backend interface {
+	// UploadFile uploads localFile to key, it gives up once ctx is done.
+	UploadFile(ctx context.Context, localFile, key string) error
+	// StatFile returns nil when key exists.
+	StatFile(ctx context.Context, key string) error
+	// Download reads key, rng is an optional http Range header value.
+	Download(ctx context.Context, key, rng string) (*RemoteObject, error)
+	// DeleteFile removes key, it succeeds when key does not exist.
+	DeleteFile(key string) error
+	// ListFiles returns the keys under prefix.
+	ListFiles(prefix string) (map[string]bool, error)
+	// GetRequest returns the plain url of key.
+	GetRequest(key string) (string, error)
+	// Presign returns a url of key that can be read without credentials until expire passes.
+	Presign(key string, expire time.Duration) (string, error)
+}
+
+// orphanCleaner is implemented by backends that leave unfinished uploads behind.
+type orphanCleaner interface {
+	AbortOrphanedUploads(ctx context.Context, prefix string, olderThan time.Duration) error
+}
+
+// pinger is implemented by backends that can check the bucket itself, the
+// others are checked by a stat of a key that does not exist.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// newBucketTransport returns the traced http transport of a cloud backend.
+func newBucketTransport(client string) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = bucketTimeout
+	return tracing.Transport(client, transport)
+}
+
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// parseByteRange parses rng, a Range header of a single byte range, into its
+// offset and length. Open ended ranges have a length of -1, suffix ranges a
+// negative offset as well.
+func parseByteRange(rng string) (offset, length int64, err error) {
+	spec, found := strings.CutPrefix(rng, "bytes=")
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found || !ok || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("invalid range %v", rng)
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid range %v", rng)
+		}
+		return -n, -1, nil
+	}
+	offset, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid range %v", rng)
+	}
+	if last == "" {
+		return offset, -1, nil
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < offset {
+		return 0, 0, fmt.Errorf("invalid range %v", rng)
+	}
+	return offset, end - offset + 1, nil
+}
+
+// BackendFactory creates a backend from the remote cache config.
+type BackendFactory func(cfg *OssCacheConfig) (Backend, error)
+
+var (
+	backendsMux sync.RWMutex
+	backends    = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a backend available as remote_cache.type name.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMux.Lock()
+	defer backendsMux.Unlock()
+	backends[name] = factory
+}
+
+func newBackend(cfg *OssCacheConfig) (Backend, error) {
+	typ := cfg.Type
+	if typ == "" {
+		typ = BackendS3
+	}
+	backendsMux.RLock()
+	factory, ok := backends[typ]
+	backendsMux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown remote cache type: %v", typ)
+	}
+	return factory(cfg)
+}
+
+func init() {
+	RegisterBackend(BackendS3, func(cfg *OssCacheConfig) (Backend, error) {
+		return NewS3Client(cfg.S3)
+	})
+}
@@ -0,0 +1,170 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testBackend runs the operations of the remote cache against b, blobs larger
+// than largeSize take the block or chunked upload path.
+func testBackend(t *testing.T, b Backend, largeSize int) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	blobs := map[string][]byte{
+		"huggingface/blobs/small": []byte("hello world"),
+		"huggingface/blobs/large": make([]byte, largeSize),
+	}
+	rand.Read(blobs["huggingface/blobs/large"])
+	for key, data := range blobs {
+		local := filepath.Join(dir, filepath.Base(key))
+		if err := os.WriteFile(local, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.UploadFile(ctx, local, key); err != nil {
+			t.Fatalf("upload %v: %v", key, err)
+		}
+		if err := b.StatFile(ctx, key); err != nil {
+			t.Fatalf("stat %v: %v", key, err)
+		}
+		obj, err := b.Download(ctx, key, "")
+		if err != nil {
+			t.Fatalf("download %v: %v", key, err)
+		}
+		got, err := io.ReadAll(obj.Body)
+		obj.Body.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("download %v: got %d bytes, want %d, err:%v", key, len(got), len(data), err)
+		}
+	}
+
+	if err := b.StatFile(ctx, "huggingface/blobs/missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stat of a missing key: %v", err)
+	}
+	if _, err := b.Download(ctx, "huggingface/blobs/missing", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("download of a missing key: %v", err)
+	}
+
+	for _, rng := range []string{"bytes=6-10", "bytes=6-", "bytes=-5"} {
+		obj, err := b.Download(ctx, "huggingface/blobs/small", rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(obj.Body)
+		obj.Body.Close()
+		if string(got) != "world" || obj.ContentLength != 5 || obj.ContentRange != "bytes 6-10/11" {
+			t.Errorf("range download %v: got %q, content range %q", rng, got, obj.ContentRange)
+		}
+	}
+
+	files, err := b.ListFiles("huggingface/blobs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range blobs {
+		if !files[key] {
+			t.Errorf("%v not listed in %v", key, files)
+		}
+	}
+
+	presigned, err := b.Presign("huggingface/blobs/small", time.Minute)
+	switch {
+	case errors.Is(err, ErrNotSupported):
+	case err != nil:
+		t.Errorf("presign: %v", err)
+	default:
+		res, err := http.Get(presigned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(got) != "hello world" {
+			t.Errorf("presigned download: status %v, got %q", res.StatusCode, got)
+		}
+	}
+
+	for key := range blobs {
+		if err := b.DeleteFile(key); err != nil {
+			t.Fatalf("delete %v: %v", key, err)
+		}
+		if err := b.StatFile(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("stat of deleted %v: %v", key, err)
+		}
+		if err := b.DeleteFile(key); err != nil {
+			t.Errorf("delete of a missing key: %v", err)
+		}
+	}
+}
+
+func TestPosixBackend(t *testing.T) {
+	b, err := newBackend(&OssCacheConfig{Type: BackendPosix, Posix: &PosixConfig{Dir: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b, 1<<20)
+}
+
+func TestParseByteRange(t *testing.T) {
+	cases := []struct {
+		rng            string
+		offset, length int64
+		ok             bool
+	}{
+		{"bytes=6-10", 6, 5, true},
+		{"bytes=6-", 6, -1, true},
+		{"bytes=-5", -5, -1, true},
+		{"bytes=10-6", 0, 0, false},
+		{"bytes=0-1,4-5", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+	}
+	for _, c := range cases {
+		offset, length, err := parseByteRange(c.rng)
+		if (err == nil) != c.ok || offset != c.offset || length != c.length {
+			t.Errorf("%v: got %v, %v, %v", c.rng, offset, length, err)
+		}
+	}
+}
+
+func TestStalledBucket(t *testing.T) {
+	timeout := bucketTimeout
+	bucketTimeout = time.Millisecond * 200
+	defer func() { bucketTimeout = timeout }()
+	bucket := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second * 30):
+		}
+	}))
+	defer bucket.Close()
+
+	backends := map[string]*OssCacheConfig{
+		BackendGcs:   {Type: BackendGcs, Gcs: &GcsConfig{Endpoint: bucket.URL, Bucket: "bkt"}},
+		BackendAzure: {Type: BackendAzure, Azure: &AzureConfig{Endpoint: bucket.URL, Account: azuriteAccount, Key: azuriteKey, Container: "c"}},
+	}
+	for name, cfg := range backends {
+		b, err := newBackend(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		begin := time.Now()
+		if err = b.StatFile(context.Background(), "huggingface/blobs/a"); err == nil {
+			t.Errorf("%v: stat of a stalled bucket succeeded", name)
+		}
+		if err = b.DeleteFile("huggingface/blobs/a"); err == nil {
+			t.Errorf("%v: delete in a stalled bucket succeeded", name)
+		}
+		if elapsed := time.Since(begin); elapsed > time.Second*5 {
+			t.Errorf("%v: calls to a stalled bucket took %v", name, elapsed)
+		}
+	}
+}
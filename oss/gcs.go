@@ -0,0 +1,212 @@
+package oss
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	"hf-mirror/units"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultGcsEndpoint = "https://storage.googleapis.com"
+
+// GcsConfig stores blobs in a Google Cloud Storage bucket through its JSON api.
+type GcsConfig struct {
+	// Endpoint is the storage api, point it at an emulator like fake-gcs-server in tests.
+	Endpoint string `yaml:"endpoint"`
+	Bucket   string `yaml:"bucket"`
+	// CredentialsFile is a service account json key, it is also needed to presign urls.
+	// Without it the application default credentials are used, like the instance
+	// metadata server, or requests are sent unauthenticated when Endpoint is not the default one.
+	CredentialsFile string `yaml:"credentials_file"`
+	// ChunkSize is the size of the chunks of resumable uploads, blobs up to it are uploaded at once.
+	ChunkSize units.ByteSize `yaml:"chunk_size"`
+}
+
+type gcsBackend struct {
+	cfg      *GcsConfig
+	endpoint string
+	bucket   *storage.BucketHandle
+	// signer holds the service account key urls are presigned with, nil without one.
+	signer *jwt.Config
+}
+
+func newGcsBackend(cfg *OssCacheConfig) (Backend, error) {
+	gcfg := cfg.Gcs
+	if gcfg == nil || gcfg.Bucket == "" {
+		return nil, fmt.Errorf("remote cache gcs bucket is not configured")
+	}
+	endpoint := strings.TrimSuffix(gcfg.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = defaultGcsEndpoint
+	}
+	g := &gcsBackend{cfg: gcfg, endpoint: endpoint}
+	auth := []option.ClientOption{option.WithScopes(storage.ScopeReadWrite)}
+	switch {
+	case gcfg.CredentialsFile != "":
+		raw, err := os.ReadFile(gcfg.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		if g.signer, err = google.JWTConfigFromJSON(raw, storage.ScopeReadWrite); err != nil {
+			return nil, fmt.Errorf("invalid gcs credentials file %v, %v", gcfg.CredentialsFile, err)
+		}
+		auth = append(auth, option.WithCredentialsJSON(raw))
+	case endpoint != defaultGcsEndpoint:
+		auth = append(auth, option.WithoutAuthentication())
+	}
+	ctx := context.Background()
+	transport, err := htransport.NewTransport(ctx, newBucketTransport("gcs"), auth...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcs transport, %v", err)
+	}
+	client, err := storage.NewClient(ctx,
+		option.WithHTTPClient(&http.Client{Transport: transport}),
+		option.WithEndpoint(endpoint+"/storage/v1/"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcs client, %v", err)
+	}
+	g.bucket = client.Bucket(gcfg.Bucket)
+	return g, nil
+}
+
+// UploadFile uploads localFile at once or, when it is larger than the chunk
+// size, in a resumable upload session. The bucket checks the upload against
+// the md5 of localFile.
+func (g *gcsBackend) UploadFile(ctx context.Context, localFile, key string) error {
+	md5Sum, err := fileMd5(localFile)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Open(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to open file %v, %v", localFile, err)
+	}
+	defer fp.Close()
+	// the upload is abandoned when ctx is cancelled before the writer is closed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := g.bucket.Object(key).NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+	w.MD5, _ = base64.StdEncoding.DecodeString(md5Sum)
+	if g.cfg.ChunkSize > 0 {
+		w.ChunkSize = int(g.cfg.ChunkSize)
+	}
+	if _, err = io.Copy(w, fp); err != nil {
+		cancel()
+		w.Close()
+		return fmt.Errorf("failed to upload file %v, %v", localFile, err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("failed to upload file %v, %v", localFile, err)
+	}
+	return nil
+}
+
+func (g *gcsBackend) StatFile(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, bucketTimeout)
+	defer cancel()
+	_, err := g.bucket.Object(key).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %v, %v", key, err)
+	}
+	return nil
+}
+
+func (g *gcsBackend) DeleteFile(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bucketTimeout)
+	defer cancel()
+	err := g.bucket.Object(key).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to delete %v, %v", key, err)
+	}
+	return nil
+}
+
+func (g *gcsBackend) Download(ctx context.Context, key, rng string) (*RemoteObject, error) {
+	offset, length := int64(0), int64(-1)
+	if rng != "" {
+		var err error
+		if offset, length, err = parseByteRange(rng); err != nil {
+			return nil, err
+		}
+	}
+	rd, err := g.bucket.Object(key).NewRangeReader(ctx, offset, length)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %v, %v", key, err)
+	}
+	obj := &RemoteObject{Body: rd, ContentLength: rd.Remain()}
+	if rng != "" {
+		start := rd.Attrs.StartOffset
+		obj.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, start+rd.Remain()-1, rd.Attrs.Size)
+	}
+	return obj, nil
+}
+
+func (g *gcsBackend) ListFiles(prefix string) (map[string]bool, error) {
+	files := make(map[string]bool)
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, err
+	}
+	it := g.bucket.Objects(context.Background(), query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files of %v, %v", prefix, err)
+		}
+		files[attrs.Name] = true
+	}
+}
+
+func (g *gcsBackend) GetRequest(key string) (string, error) {
+	return g.endpoint + "/" + g.cfg.Bucket + "/" + escapeKey(key), nil
+}
+
+// Presign returns a V4 signed url of key, signed with the service account key.
+func (g *gcsBackend) Presign(key string, expire time.Duration) (string, error) {
+	if g.signer == nil {
+		return "", ErrNotSupported
+	}
+	opts := &storage.SignedURLOptions{
+		GoogleAccessID: g.signer.Email,
+		PrivateKey:     g.signer.PrivateKey,
+		Method:         http.MethodGet,
+		Expires:        timeNow().Add(expire),
+		Scheme:         storage.SigningSchemeV4,
+	}
+	if g.endpoint != defaultGcsEndpoint {
+		endpoint, err := url.Parse(g.endpoint)
+		if err != nil {
+			return "", err
+		}
+		opts.Hostname = endpoint.Host
+		opts.Insecure = endpoint.Scheme == "http"
+	}
+	return storage.SignedURL(g.cfg.Bucket, key, opts)
+}
+
+func init() {
+	RegisterBackend(BackendGcs, newGcsBackend)
+}
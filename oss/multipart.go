@@ -0,0 +1,271 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minPartSize = 5 << 20
+	maxParts    = 10000
+)
+
+// partSizeFor returns the part size used for a file of size, the configured
+// part size grows when the file would need more parts than s3 allows.
+func (s *S3) partSizeFor(size int64) int64 {
+	partSize := int64(s.cfg.PartSize)
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	if n := (size + maxParts - 1) / maxParts; n > partSize {
+		partSize = n
+	}
+	return partSize
+}
+
+// uploadMultipart uploads localFile in parts, parts left by a previous
+// attempt of the same remoteFile are reused so an interrupted upload resumes.
+func (s *S3) uploadMultipart(ctx context.Context, localFile, remoteFile string, size int64) error {
+	fp, err := os.Open(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to open file %v, %v", localFile, err)
+	}
+	defer fp.Close()
+
+	partSize := s.partSizeFor(size)
+	partCount := int((size + partSize - 1) / partSize)
+	uploadId, done, err := s.resumeMultipart(ctx, fp, remoteFile, size, partSize)
+	if err != nil {
+		return err
+	}
+	if uploadId == "" {
+		out, err := s.client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+			Bucket: aws.String(s.cfg.Bucket),
+			Key:    aws.String(remoteFile),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create multipart upload of %v, %v", remoteFile, err)
+		}
+		uploadId = aws.StringValue(out.UploadId)
+	} else {
+		log.WithFields(log.Fields{"remote": remoteFile, "upload_id": uploadId}).
+			Infof("resume multipart upload, uploaded parts:%v/%v", len(done), partCount)
+	}
+
+	parts := make(chan int64)
+	var (
+		mux      sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	concurrent := s.cfg.PartConcurrent
+	if concurrent <= 0 {
+		concurrent = 1
+	}
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, partSize)
+			for number := range parts {
+				offset := (number - 1) * partSize
+				n := partSize
+				if offset+n > size {
+					n = size - offset
+				}
+				etag, err := s.uploadPart(ctx, fp, remoteFile, uploadId, number, offset, buf[:n])
+				mux.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if err == nil {
+					done[number] = etag
+				}
+				mux.Unlock()
+			}
+		}()
+	}
+	for number := int64(1); number <= int64(partCount); number++ {
+		mux.Lock()
+		_, uploaded := done[number]
+		failed := firstErr != nil
+		mux.Unlock()
+		if failed {
+			break
+		}
+		if !uploaded {
+			parts <- number
+		}
+	}
+	close(parts)
+	wg.Wait()
+	if firstErr != nil {
+		// the upload is kept so that the next attempt resumes it
+		return firstErr
+	}
+
+	completed := make([]*s3.CompletedPart, 0, len(done))
+	for number, etag := range done {
+		completed = append(completed, &s3.CompletedPart{
+			ETag:       aws.String(etag),
+			PartNumber: aws.Int64(number),
+		})
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		return aws.Int64Value(completed[i].PartNumber) < aws.Int64Value(completed[j].PartNumber)
+	})
+	_, err = s.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.cfg.Bucket),
+		Key:             aws.String(remoteFile),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload of %v, %v", remoteFile, err)
+	}
+	log.WithFields(log.Fields{"remote": remoteFile, "parts": partCount}).Infof("multipart upload success")
+	return nil
+}
+
+// uploadPart reads one part into buf and uploads it with its md5, so the file is read only once.
+func (s *S3) uploadPart(ctx context.Context, fp *os.File, remoteFile, uploadId string, number, offset int64, buf []byte) (string, error) {
+	if _, err := fp.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read part %v of %v, %v", number, fp.Name(), err)
+	}
+	sum := md5.Sum(buf)
+	out, err := s.client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+		Body:          bytes.NewReader(buf),
+		Bucket:        aws.String(s.cfg.Bucket),
+		Key:           aws.String(remoteFile),
+		UploadId:      aws.String(uploadId),
+		PartNumber:    aws.Int64(number),
+		ContentLength: aws.Int64(int64(len(buf))),
+		ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload part %v of %v, %v", number, remoteFile, err)
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+// resumeMultipart looks for an unfinished upload of remoteFile and returns
+// its id with the etags of the parts already uploaded. An upload that was
+// split with a different part size can't be resumed and is aborted, parts
+// whose etag is not the md5 of the same part of fp are uploaded again.
+func (s *S3) resumeMultipart(ctx context.Context, fp *os.File, remoteFile string, size, partSize int64) (string, map[int64]string, error) {
+	done := make(map[int64]string)
+	uploads, err := s.listMultipartUploads(ctx, remoteFile)
+	if err != nil {
+		return "", nil, err
+	}
+	var latest *s3.MultipartUpload
+	for _, u := range uploads {
+		if aws.StringValue(u.Key) != remoteFile {
+			continue
+		}
+		if latest == nil || aws.TimeValue(u.Initiated).After(aws.TimeValue(latest.Initiated)) {
+			latest = u
+		}
+	}
+	if latest == nil {
+		return "", done, nil
+	}
+	uploadId := aws.StringValue(latest.UploadId)
+	var listed []*s3.Part
+	err = s.client.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(s.cfg.Bucket),
+		Key:      aws.String(remoteFile),
+		UploadId: aws.String(uploadId),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		listed = append(listed, page.Parts...)
+		return true
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list parts of %v, %v", remoteFile, err)
+	}
+	buf := make([]byte, partSize)
+	for _, p := range listed {
+		number := aws.Int64Value(p.PartNumber)
+		offset := (number - 1) * partSize
+		expect := partSize
+		if number*partSize > size {
+			expect = size - offset
+		}
+		if aws.Int64Value(p.Size) != expect {
+			log.WithFields(log.Fields{"remote": remoteFile, "upload_id": uploadId}).
+				Warnf("abort multipart upload with a different part size")
+			s.abortMultipart(ctx, remoteFile, uploadId)
+			return "", make(map[int64]string), nil
+		}
+		if _, err := fp.ReadAt(buf[:expect], offset); err != nil && err != io.EOF {
+			return "", nil, fmt.Errorf("failed to read part %v of %v, %v", number, fp.Name(), err)
+		}
+		sum := md5.Sum(buf[:expect])
+		etag := aws.StringValue(p.ETag)
+		if strings.Trim(etag, `"`) != hex.EncodeToString(sum[:]) {
+			log.WithFields(log.Fields{"remote": remoteFile, "upload_id": uploadId, "part": number}).
+				Warnf("upload part again, its etag does not match the local file")
+			continue
+		}
+		done[number] = etag
+	}
+	return uploadId, done, nil
+}
+
+func (s *S3) listMultipartUploads(ctx context.Context, prefix string) ([]*s3.MultipartUpload, error) {
+	var uploads []*s3.MultipartUpload
+	err := s.client.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.cfg.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		uploads = append(uploads, page.Uploads...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list multipart uploads of %v, %v", prefix, err)
+	}
+	return uploads, nil
+}
+
+func (s *S3) abortMultipart(ctx context.Context, remoteFile, uploadId string) {
+	_, err := s.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.cfg.Bucket),
+		Key:      aws.String(remoteFile),
+		UploadId: aws.String(uploadId),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"remote": remoteFile, "upload_id": uploadId}).
+			Errorf("abort multipart upload failed, err:%v", err)
+	}
+}
+
+// AbortOrphanedUploads aborts the multipart uploads under prefix that were
+// started before olderThan ago, their parts would otherwise be billed forever.
+func (s *S3) AbortOrphanedUploads(ctx context.Context, prefix string, olderThan time.Duration) error {
+	uploads, err := s.listMultipartUploads(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(-olderThan)
+	for _, u := range uploads {
+		if aws.TimeValue(u.Initiated).Before(deadline) {
+			log.WithFields(log.Fields{"remote": aws.StringValue(u.Key), "upload_id": aws.StringValue(u.UploadId)}).
+				Infof("abort orphaned multipart upload")
+			s.abortMultipart(ctx, aws.StringValue(u.Key), aws.StringValue(u.UploadId))
+		}
+	}
+	return nil
+}
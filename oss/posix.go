@@ -0,0 +1,165 @@
+package oss
+
+import (
+	"context"
+	"fmt"
+	"hf-mirror/fs"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PosixConfig stores blobs in a directory, typically a shared NFS or CephFS mount.
+type PosixConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+type posixBackend struct {
+	dir string
+}
+
+func newPosixBackend(cfg *OssCacheConfig) (Backend, error) {
+	if cfg.Posix == nil || cfg.Posix.Dir == "" {
+		return nil, fmt.Errorf("remote cache posix dir is not configured")
+	}
+	if err := os.MkdirAll(cfg.Posix.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return &posixBackend{dir: cfg.Posix.Dir}, nil
+}
+
+func (p *posixBackend) path(key string) string {
+	return filepath.Join(p.dir, filepath.FromSlash(key))
+}
+
+// UploadFile copies localFile to a tmp file next to key and renames it, so
+// readers on other nodes never see a partially written blob.
+func (p *posixBackend) UploadFile(ctx context.Context, localFile, key string) error {
+	src, err := os.Open(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to open file %v, %v", localFile, err)
+	}
+	defer src.Close()
+	dst := p.path(key)
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, src)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to copy file %v to %v, %v", localFile, dst, err)
+	}
+	return nil
+}
+
+func (p *posixBackend) Ping(ctx context.Context) error {
+	info, err := os.Stat(p.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("remote cache posix dir %v is not a directory", p.dir)
+	}
+	return nil
+}
+
+func (p *posixBackend) StatFile(ctx context.Context, key string) error {
+	_, err := os.Stat(p.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (p *posixBackend) DeleteFile(key string) error {
+	if err := os.Remove(p.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *posixBackend) Download(ctx context.Context, key, rng string) (*RemoteObject, error) {
+	fd, err := os.Open(p.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	size := info.Size()
+	if rng == "" {
+		return &RemoteObject{Body: fd, ContentLength: size}, nil
+	}
+	r, ok := fs.ParseRange(rng, size)
+	if !ok {
+		fd.Close()
+		return nil, fmt.Errorf("unsatisfiable range %q of %v", rng, key)
+	}
+	return &RemoteObject{
+		Body: readCloser{
+			Reader: io.NewSectionReader(fd, r.Start, r.End-r.Start),
+			Closer: fd,
+		},
+		ContentLength: r.End - r.Start,
+		ContentRange:  fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End-1, size),
+	}, nil
+}
+
+func (p *posixBackend) ListFiles(prefix string) (map[string]bool, error) {
+	files := make(map[string]bool)
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	entries, err := os.ReadDir(p.path(dir))
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		key := dir + e.Name()
+		if !e.IsDir() && strings.HasPrefix(key, prefix) && !strings.HasSuffix(key, ".tmp") {
+			files[key] = true
+		}
+	}
+	return files, nil
+}
+
+func (p *posixBackend) GetRequest(key string) (string, error) {
+	return "file://" + p.path(key), nil
+}
+
+func (p *posixBackend) Presign(key string, expire time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func init() {
+	RegisterBackend(BackendPosix, newPosixBackend)
+}
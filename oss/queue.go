@@ -0,0 +1,339 @@
+package oss
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"hf-mirror/metacache"
+	"sync"
+	"time"
+)
+
+const (
+	pendingBucket = "pending"
+	// dueBucket indexes the pending tasks by their next attempt, keys are the
+	// big endian next attempt followed by the file.
+	dueBucket  = "due"
+	deadBucket = "dead"
+
+	maxRetryBackoff = time.Hour
+)
+
+// uploadTask is a journal entry of a local blob waiting to be uploaded.
+type uploadTask struct {
+	File string `json:"file"`
+	// Seq tells a task enqueued again after a purge from the one it replaced.
+	Seq         uint64 `json:"seq"`
+	Attempts    int    `json:"attempts"`
+	EnqueuedAt  int64  `json:"enqueued_at"`
+	NextAttempt int64  `json:"next_attempt"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+type QueueStats struct {
+	Pending  int `json:"pending"`
+	Inflight int `json:"inflight"`
+	Dead     int `json:"dead"`
+	Workers  int `json:"workers"`
+	// InflightSince is when the longest running upload started, nil when none runs.
+	InflightSince *time.Time `json:"inflight_since,omitempty"`
+	// LastPoll is when a worker last looked for a due task.
+	LastPoll time.Time `json:"last_poll"`
+}
+
+// uploadQueue is an on-disk journal of pending uploads, so that blobs
+// committed before a restart are still uploaded after it. Tasks failing
+// maxAttempts times are moved to the dead letter bucket.
+type uploadQueue struct {
+	db          *bolt.DB
+	wake        chan struct{}
+	backoff     time.Duration
+	maxAttempts int
+
+	mux      sync.Mutex
+	inflight map[string]time.Time
+	// removed are inflight files dropped from the journal while being uploaded.
+	removed  map[string]bool
+	lastPoll time.Time
+}
+
+func openUploadQueue(path string, backoff time.Duration, maxAttempts int) (*uploadQueue, error) {
+	db, err := metacache.OpenBoltDB(path)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range []string{pendingBucket, deadBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
+		}
+		return rebuildDueIndex(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &uploadQueue{
+		db:          db,
+		wake:        make(chan struct{}, 1),
+		backoff:     backoff,
+		maxAttempts: maxAttempts,
+		inflight:    make(map[string]time.Time),
+		removed:     make(map[string]bool),
+	}, nil
+}
+
+func putTask(b *bolt.Bucket, task *uploadTask) error {
+	raw, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(task.File), raw)
+}
+
+func getTask(b *bolt.Bucket, file string) *uploadTask {
+	raw := b.Get([]byte(file))
+	if raw == nil {
+		return nil
+	}
+	task := &uploadTask{}
+	if err := json.Unmarshal(raw, task); err != nil {
+		log.WithFields(log.Fields{"file": file}).Errorf("fail to unmarshal upload task, err:%v", err)
+		return nil
+	}
+	return task
+}
+
+func dueKey(task *uploadTask) []byte {
+	key := make([]byte, 8, 8+len(task.File))
+	binary.BigEndian.PutUint64(key, uint64(task.NextAttempt))
+	return append(key, task.File...)
+}
+
+// putPending journals task and indexes it by its next attempt.
+func putPending(tx *bolt.Tx, task *uploadTask) error {
+	if err := deletePending(tx, task.File); err != nil {
+		return err
+	}
+	if err := putTask(tx.Bucket([]byte(pendingBucket)), task); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(dueBucket)).Put(dueKey(task), []byte{})
+}
+
+func deletePending(tx *bolt.Tx, file string) error {
+	pending := tx.Bucket([]byte(pendingBucket))
+	if old := getTask(pending, file); old != nil {
+		if err := tx.Bucket([]byte(dueBucket)).Delete(dueKey(old)); err != nil {
+			return err
+		}
+	}
+	return pending.Delete([]byte(file))
+}
+
+// rebuildDueIndex indexes the pending tasks again, journals written before
+// the index existed have none.
+func rebuildDueIndex(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(dueBucket)) != nil {
+		if err := tx.DeleteBucket([]byte(dueBucket)); err != nil {
+			return err
+		}
+	}
+	due, err := tx.CreateBucket([]byte(dueBucket))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(pendingBucket)).ForEach(func(k, v []byte) error {
+		task := &uploadTask{}
+		if err := json.Unmarshal(v, task); err != nil {
+			log.WithFields(log.Fields{"file": string(k)}).Errorf("fail to unmarshal upload task, err:%v", err)
+			return nil
+		}
+		return due.Put(dueKey(task), []byte{})
+	})
+}
+
+// enqueue journals file unless it is pending already, a dead letter of file is retried.
+func (q *uploadQueue) enqueue(file string) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket([]byte(pendingBucket))
+		if pending.Get([]byte(file)) != nil {
+			return nil
+		}
+		tx.Bucket([]byte(deadBucket)).Delete([]byte(file))
+		seq, err := pending.NextSequence()
+		if err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		return putPending(tx, &uploadTask{File: file, Seq: seq, EnqueuedAt: now, NextAttempt: now})
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next claims the pending task that is due first. When none is due task is
+// nil and wait is how long until one becomes due, 0 when none is pending.
+func (q *uploadQueue) next() (task *uploadTask, wait time.Duration, err error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.lastPoll = time.Now()
+	now := q.lastPoll.Unix()
+	earliest := int64(-1)
+	err = q.db.View(func(tx *bolt.Tx) error {
+		pending := tx.Bucket([]byte(pendingBucket))
+		// only the inflight tasks are skipped, there are no more than workers
+		c := tx.Bucket([]byte(dueBucket)).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			file := string(k[8:])
+			if _, ok := q.inflight[file]; ok {
+				continue
+			}
+			if due := int64(binary.BigEndian.Uint64(k)); due > now {
+				earliest = due
+				return nil
+			}
+			if task = getTask(pending, file); task != nil {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if task != nil {
+		q.inflight[task.File] = q.lastPoll
+		return task, 0, nil
+	}
+	if earliest < 0 {
+		return nil, 0, nil
+	}
+	return nil, time.Duration(earliest-now) * time.Second, nil
+}
+
+// done removes a finished task from the journal, unless the file was purged
+// and enqueued again while it ran.
+func (q *uploadQueue) done(task *uploadTask) {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		if cur := getTask(tx.Bucket([]byte(pendingBucket)), task.File); cur == nil || cur.Seq != task.Seq {
+			return nil
+		}
+		return deletePending(tx, task.File)
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"file": task.File}).Errorf("fail to remove upload task, err:%v", err)
+	}
+	q.release(task)
+}
+
+// fail schedules a retry of task with exponential backoff, or moves it to
+// the dead letters once it has failed maxAttempts times.
+func (q *uploadQueue) fail(task *uploadTask, cause error) {
+	task.Attempts++
+	task.LastError = cause.Error()
+	backoff := q.backoff << (task.Attempts - 1)
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	task.NextAttempt = time.Now().Add(backoff).Unix()
+	dead := q.maxAttempts > 0 && task.Attempts >= q.maxAttempts
+	// a task removed while it ran is not rescheduled
+	q.mux.Lock()
+	removed := q.removed[task.File]
+	var err error
+	if !removed {
+		err = q.db.Update(func(tx *bolt.Tx) error {
+			if !dead {
+				return putPending(tx, task)
+			}
+			if err := deletePending(tx, task.File); err != nil {
+				return err
+			}
+			return putTask(tx.Bucket([]byte(deadBucket)), task)
+		})
+	}
+	delete(q.inflight, task.File)
+	delete(q.removed, task.File)
+	q.mux.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{"file": task.File}).Errorf("fail to reschedule upload task, err:%v", err)
+	}
+	if dead && !removed {
+		log.WithFields(log.Fields{"file": task.File, "attempts": task.Attempts}).
+			Errorf("upload moved to dead letters, err:%v", cause)
+	}
+}
+
+func (q *uploadQueue) release(task *uploadTask) {
+	q.mux.Lock()
+	delete(q.inflight, task.File)
+	delete(q.removed, task.File)
+	q.mux.Unlock()
+}
+
+// remove drops the pending task or dead letter of file. A running upload of
+// file is not retried anymore and reported by wasRemoved.
+func (q *uploadQueue) remove(file string) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if _, ok := q.inflight[file]; ok {
+		q.removed[file] = true
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if err := deletePending(tx, file); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(deadBucket)).Delete([]byte(file))
+	})
+}
+
+// wasRemoved reports whether the claimed task was removed while it ran.
+func (q *uploadQueue) wasRemoved(task *uploadTask) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.removed[task.File]
+}
+
+// contains reports whether file is pending or a dead letter.
+func (q *uploadQueue) contains(file string) bool {
+	found := false
+	q.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(pendingBucket)).Get([]byte(file)) != nil ||
+			tx.Bucket([]byte(deadBucket)).Get([]byte(file)) != nil
+		return nil
+	})
+	return found
+}
+
+func (q *uploadQueue) stats() QueueStats {
+	var stats QueueStats
+	q.db.View(func(tx *bolt.Tx) error {
+		stats.Pending = tx.Bucket([]byte(pendingBucket)).Stats().KeyN
+		stats.Dead = tx.Bucket([]byte(deadBucket)).Stats().KeyN
+		return nil
+	})
+	q.mux.Lock()
+	stats.Inflight = len(q.inflight)
+	stats.LastPoll = q.lastPoll
+	for _, started := range q.inflight {
+		if stats.InflightSince == nil || started.Before(*stats.InflightSince) {
+			started := started
+			stats.InflightSince = &started
+		}
+	}
+	q.mux.Unlock()
+	return stats
+}
+
+func (q *uploadQueue) close() error {
+	return q.db.Close()
+}
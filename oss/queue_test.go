@@ -0,0 +1,199 @@
+package oss
+
+import (
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestQueue(t *testing.T, path string, maxAttempts int) *uploadQueue {
+	q, err := openUploadQueue(path, time.Minute, maxAttempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func claim(t *testing.T, q *uploadQueue, file string) *uploadTask {
+	task, _, err := q.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task == nil || task.File != file {
+		t.Fatalf("claimed %+v, want %v", task, file)
+	}
+	return task
+}
+
+// makeDue pretends the retry of a failed task became due.
+func makeDue(t *testing.T, q *uploadQueue, task *uploadTask) {
+	task.NextAttempt = 0
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		return putPending(tx, task)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadQueueBackoff(t *testing.T) {
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), 0)
+	defer q.close()
+	if task, wait, err := q.next(); task != nil || wait != 0 || err != nil {
+		t.Fatalf("empty queue returned %+v, %v, %v", task, wait, err)
+	}
+	if err := q.enqueue("/blobs/a"); err != nil {
+		t.Fatal(err)
+	}
+	task := claim(t, q, "/blobs/a")
+	if task, _, _ := q.next(); task != nil {
+		t.Fatalf("claimed inflight task %+v twice", task)
+	}
+
+	for attempt, backoff := range []time.Duration{time.Minute, time.Minute * 2, time.Minute * 4} {
+		if attempt > 0 {
+			makeDue(t, q, task)
+			task = claim(t, q, "/blobs/a")
+		}
+		q.fail(task, errors.New("bucket unreachable"))
+		due, wait, err := q.next()
+		if err != nil || due != nil {
+			t.Fatalf("attempt %d: failed task due right away: %+v, err:%v", attempt+1, due, err)
+		}
+		if wait < backoff-time.Second*2 || wait > backoff {
+			t.Errorf("attempt %d: retry in %v, want %v", attempt+1, wait, backoff)
+		}
+	}
+	if stats := q.stats(); stats.Pending != 1 || stats.Inflight != 0 || stats.Dead != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestUploadQueueDeadLetters(t *testing.T) {
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), 2)
+	defer q.close()
+	q.enqueue("/blobs/a")
+	task := claim(t, q, "/blobs/a")
+	q.fail(task, errors.New("first"))
+	makeDue(t, q, task)
+	task = claim(t, q, "/blobs/a")
+	q.fail(task, errors.New("second"))
+
+	if stats := q.stats(); stats.Pending != 0 || stats.Dead != 1 {
+		t.Fatalf("task not dead lettered, stats %+v", stats)
+	}
+	if !q.contains("/blobs/a") {
+		t.Error("dead letter not reported by contains")
+	}
+	if task, wait, _ := q.next(); task != nil || wait != 0 {
+		t.Errorf("dead letter claimed: %+v, %v", task, wait)
+	}
+
+	// committing the blob again retries it
+	q.enqueue("/blobs/a")
+	if stats := q.stats(); stats.Pending != 1 || stats.Dead != 0 {
+		t.Fatalf("dead letter not revived, stats %+v", stats)
+	}
+	if task := claim(t, q, "/blobs/a"); task.Attempts != 0 {
+		t.Errorf("revived task kept %d attempts", task.Attempts)
+	}
+}
+
+func TestUploadQueueRestartRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	q := openTestQueue(t, path, 0)
+	q.enqueue("/blobs/a")
+	q.enqueue("/blobs/b")
+	done := claim(t, q, "/blobs/a")
+	q.done(done)
+	// the process dies while b is uploaded
+	claim(t, q, "/blobs/b")
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openTestQueue(t, path, 0)
+	defer q.close()
+	if stats := q.stats(); stats.Pending != 1 || stats.Inflight != 0 {
+		t.Fatalf("unexpected stats after restart %+v", stats)
+	}
+	claim(t, q, "/blobs/b")
+}
+
+func TestUploadQueueRemove(t *testing.T) {
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), 1)
+	defer q.close()
+	q.enqueue("/blobs/a")
+	q.enqueue("/blobs/b")
+	q.enqueue("/blobs/c")
+	task := claim(t, q, "/blobs/a")
+	// b is purged while pending, a while it is uploaded
+	if err := q.remove("/blobs/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.remove("/blobs/a"); err != nil {
+		t.Fatal(err)
+	}
+	if !q.wasRemoved(task) {
+		t.Error("removal of a running upload not reported")
+	}
+	q.fail(task, errors.New("bucket unreachable"))
+	if q.contains("/blobs/a") || q.contains("/blobs/b") {
+		t.Error("removed task still journaled")
+	}
+	dead := claim(t, q, "/blobs/c")
+	q.fail(dead, errors.New("bucket unreachable"))
+	if err := q.remove("/blobs/c"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := q.stats(); stats.Pending != 0 || stats.Inflight != 0 || stats.Dead != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestUploadQueueDueOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	q := openTestQueue(t, path, 0)
+	q.enqueue("/blobs/a")
+	q.enqueue("/blobs/b")
+	a := claim(t, q, "/blobs/a")
+	q.fail(a, errors.New("bucket unreachable"))
+	// the journal is read by due time, not by file
+	b := claim(t, q, "/blobs/b")
+	q.done(b)
+	if task, wait, _ := q.next(); task != nil || wait <= 0 {
+		t.Fatalf("retry claimed before it is due: %+v, %v", task, wait)
+	}
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openTestQueue(t, path, 0)
+	defer q.close()
+	if task, wait, _ := q.next(); task != nil || wait <= 0 {
+		t.Fatalf("index lost on restart: %+v, %v", task, wait)
+	}
+	makeDue(t, q, a)
+	claim(t, q, "/blobs/a")
+}
+
+func TestUploadQueueEnqueueWhilePurged(t *testing.T) {
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), 0)
+	defer q.close()
+	q.enqueue("/blobs/a")
+	task := claim(t, q, "/blobs/a")
+	// the blob is purged and committed again while the old upload runs
+	if err := q.remove("/blobs/a"); err != nil {
+		t.Fatal(err)
+	}
+	q.enqueue("/blobs/a")
+	q.done(task)
+	if !q.contains("/blobs/a") {
+		t.Fatal("task enqueued again removed by the purged upload")
+	}
+	if again := claim(t, q, "/blobs/a"); again.Seq == task.Seq {
+		t.Errorf("enqueued again with the same seq %v", again.Seq)
+	}
+}
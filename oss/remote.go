@@ -1,22 +1,55 @@
 package oss
 
 import (
+	"context"
+	"errors"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"hf-mirror/fs"
+	"hf-mirror/metrics"
+	"hf-mirror/tracing"
+	"io"
+	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 const (
 	defaultBlobDir = "huggingface/blobs/"
+
+	// abortGrace is how long Close waits for aborted uploads to return.
+	abortGrace = 5 * time.Second
 )
 
 type OssCacheConfig struct {
-	CacheDir   string  `yaml:"cache_dir"`
-	S3         *Config `yaml:"s3"`
-	Concurrent int     `yaml:"concurrent"`
+	// Type selects the storage backend, one of "s3", "posix", "azure" or "gcs".
+	Type       string       `yaml:"type"`
+	CacheDir   string       `yaml:"cache_dir"`
+	S3         *Config      `yaml:"s3"`
+	Posix      *PosixConfig `yaml:"posix"`
+	Azure      *AzureConfig `yaml:"azure"`
+	Gcs        *GcsConfig   `yaml:"gcs"`
+	Concurrent int          `yaml:"concurrent"`
+	// AbortUploadsAfter is the age after which unfinished multipart uploads
+	// are considered orphaned and aborted, they are resumed until then.
+	AbortUploadsAfter time.Duration `yaml:"abort_uploads_after"`
+	// QueuePath is the journal of pending uploads, they survive restarts.
+	QueuePath string `yaml:"queue_path"`
+	// RetryBackoff is the delay before a failed upload is retried, doubled on every attempt.
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// MaxAttempts is how often an upload is tried before it is moved to the dead letters.
+	MaxAttempts int `yaml:"max_attempts"`
+	// ReconcileOnStart enqueues local blobs that are missing in the bucket at startup.
+	ReconcileOnStart bool `yaml:"reconcile_on_start"`
+	// ShutdownTimeout is how long running uploads may take to finish after the
+	// in-flight downloads were drained on shutdown, before they are aborted.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
 }
 
 func NewOssCacheConfig() *OssCacheConfig {
 	return &OssCacheConfig{
+		Type:     BackendS3,
 		CacheDir: defaultBlobDir,
 		S3: &Config{
 			Endpoint: "",
@@ -24,65 +57,315 @@ func NewOssCacheConfig() *OssCacheConfig {
 			Bucket:   "",
 			Ak:       "",
 			Sk:       "",
+			Profile:  "",
+
+			PathStyle:          true,
+			CaBundle:           "",
+			InsecureSkipVerify: false,
+			MultipartThreshold: 64 << 20,
+			PartSize:           64 << 20,
+			PartConcurrent:     4,
+		},
+		Posix: &PosixConfig{
+			Dir: "",
+		},
+		Azure: &AzureConfig{
+			Endpoint:  "",
+			Account:   "",
+			Key:       "",
+			Sas:       "",
+			Container: "",
+			BlockSize: 64 << 20,
 		},
-		Concurrent: 3,
+		Gcs: &GcsConfig{
+			Endpoint:        defaultGcsEndpoint,
+			Bucket:          "",
+			CredentialsFile: "",
+			ChunkSize:       64 << 20,
+		},
+		Concurrent:        3,
+		AbortUploadsAfter: time.Hour * 24,
+		QueuePath:         "/hf-mirror/meta/upload_queue.db",
+		RetryBackoff:      time.Second * 30,
+		MaxAttempts:       10,
+		ReconcileOnStart:  true,
+		ShutdownTimeout:   time.Second * 30,
 	}
 }
 
+// RemoteObject is a blob, or a range of it, being read from the storage backend.
+type RemoteObject struct {
+	Body          io.ReadCloser
+	ContentLength int64
+	// ContentRange is set when a range was requested.
+	ContentRange string
+}
+
 type RemoteCache interface {
 	UploadFile(file string)
 	GetRequest(file string) (string, error)
-	StatFile(file string) error
+	// PresignRequest returns a url clients can download file from directly, valid for expire.
+	PresignRequest(file string, expire time.Duration) (string, error)
+	StatFile(ctx context.Context, file string) error
+	// DeleteFile removes file from the bucket and drops its pending upload.
+	DeleteFile(file string) error
+	// Download reads file from the bucket, rng is an optional http Range header value.
+	Download(ctx context.Context, file string, rng string) (*RemoteObject, error)
+	// Reconcile enqueues the blobs of the local cache dir that are missing in the bucket.
+	Reconcile(localDir string) error
+	UploadStats() QueueStats
+	// Ping checks that the bucket is reachable.
+	Ping(ctx context.Context) error
+	// Close stops the upload workers, waits for running uploads until ctx is
+	// done, aborts the ones left and closes the upload queue. Unfinished uploads
+	// are retried after a restart.
+	Close(ctx context.Context) error
 }
 
 type remoteCache struct {
-	s3         *S3
-	file       chan string
+	backend    Backend
+	queue      *uploadQueue
 	concurrent int
 	blobdir    string
+	stop       chan struct{}
+	workers    sync.WaitGroup
+	// ctx of the uploads, abort cancels it on shutdown.
+	ctx   context.Context
+	abort context.CancelFunc
+
+	abortUploadsAfter time.Duration
 }
 
 func NewRemoteCache(cfg *OssCacheConfig) RemoteCache {
+	queue, err := openUploadQueue(cfg.QueuePath, cfg.RetryBackoff, cfg.MaxAttempts)
+	if err != nil {
+		panic(err)
+	}
+	backend, err := newBackend(cfg)
+	if err != nil {
+		panic(err)
+	}
+	ctx, abort := context.WithCancel(context.Background())
 	c := &remoteCache{
-		s3:         NewS3Client(cfg.S3),
-		file:       make(chan string, 1024),
+		backend:    backend,
+		queue:      queue,
 		concurrent: cfg.Concurrent,
 		blobdir:    cfg.CacheDir,
+		stop:       make(chan struct{}),
+		ctx:        ctx,
+		abort:      abort,
+
+		abortUploadsAfter: cfg.AbortUploadsAfter,
 	}
 	c.runUploadWorkers()
+	go c.runOrphanCleaner()
+	c.registerMetrics()
 	return c
 }
 
+func (r *remoteCache) registerMetrics() {
+	metrics.GaugeFunc("upload_queue_pending", "Blobs waiting to be uploaded to the remote cache.", func() float64 {
+		return float64(r.queue.stats().Pending)
+	})
+	metrics.GaugeFunc("upload_queue_inflight", "Blobs being uploaded to the remote cache.", func() float64 {
+		return float64(r.queue.stats().Inflight)
+	})
+	metrics.GaugeFunc("upload_queue_dead", "Blobs that could not be uploaded to the remote cache.", func() float64 {
+		return float64(r.queue.stats().Dead)
+	})
+}
+
 func (r *remoteCache) runUploadWorkers() {
 	for i := 0; i < r.concurrent; i++ {
+		r.workers.Add(1)
 		go func() {
+			defer r.workers.Done()
 			for {
 				select {
-				case localFile := <-r.file:
-					remoteFile := r.blobdir + filepath.Base(localFile)
-					if err := r.s3.UploadFile(localFile, remoteFile); err != nil {
-						log.WithFields(log.Fields{"local": localFile, "remote": remoteFile}).
-							Errorf("upload file to s3 error:%v", err)
-					}
+				case <-r.stop:
+					return
+				default:
+				}
+				task, wait, err := r.queue.next()
+				if task != nil {
+					r.upload(task)
+					continue
 				}
+				if err != nil {
+					log.Errorf("read upload queue failed, err:%v", err)
+				}
+				if err != nil || wait == 0 {
+					wait = time.Minute
+				}
+				timer := time.NewTimer(wait)
+				select {
+				case <-r.queue.wake:
+				case <-timer.C:
+				case <-r.stop:
+				}
+				timer.Stop()
 			}
 		}()
 	}
 }
 
+func (r *remoteCache) upload(task *uploadTask) {
+	localFile := task.File
+	remoteFile := r.blobdir + filepath.Base(localFile)
+	if _, err := os.Stat(localFile); os.IsNotExist(err) {
+		log.WithFields(log.Fields{"local": localFile}).Warnf("blob is gone before it was uploaded")
+		r.queue.done(task)
+		return
+	}
+	if err := r.backend.StatFile(r.ctx, remoteFile); err == nil {
+		r.queue.done(task)
+		return
+	}
+	if err := r.backend.UploadFile(r.ctx, localFile, remoteFile); err != nil {
+		if r.ctx.Err() != nil {
+			// aborted on shutdown, it stays pending without counting as an attempt
+			r.queue.release(task)
+			return
+		}
+		log.WithFields(log.Fields{"local": localFile, "remote": remoteFile, "attempts": task.Attempts + 1}).
+			Errorf("upload file to remote storage error:%v", err)
+		metrics.RemoteUploads.WithLabelValues("failed").Inc()
+		r.queue.fail(task, err)
+		return
+	}
+	metrics.RemoteUploads.WithLabelValues("uploaded").Inc()
+	if r.queue.wasRemoved(task) {
+		// the blob was purged while it was uploaded
+		if err := r.backend.DeleteFile(remoteFile); err != nil {
+			log.WithFields(log.Fields{"remote": remoteFile}).Errorf("delete purged upload failed, err:%v", err)
+		}
+	}
+	r.queue.done(task)
+}
+
+func (r *remoteCache) Close(ctx context.Context) error {
+	close(r.stop)
+	done := make(chan struct{})
+	go func() {
+		r.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if stats := r.queue.stats(); stats.Inflight > 0 {
+			log.WithFields(log.Fields{"inflight": stats.Inflight, "pending": stats.Pending}).
+				Warnf("abort uploads still running on shutdown, they are retried after a restart")
+		}
+		r.abort()
+		// the workers still write to the queue, it is closed once they returned
+		select {
+		case <-done:
+		case <-time.After(abortGrace):
+			log.Warnf("aborted uploads did not return in %v", abortGrace)
+		}
+	}
+	r.abort()
+	return r.queue.close()
+}
+
+// runOrphanCleaner periodically aborts multipart uploads that were never
+// completed, e.g. because their blob was evicted before it could be resumed.
+func (r *remoteCache) runOrphanCleaner() {
+	cleaner, ok := r.backend.(orphanCleaner)
+	if !ok || r.abortUploadsAfter <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := cleaner.AbortOrphanedUploads(r.ctx, r.blobdir, r.abortUploadsAfter); err != nil {
+			log.WithFields(log.Fields{"prefix": r.blobdir}).Errorf("abort orphaned uploads failed, err:%v", err)
+		}
+		<-ticker.C
+	}
+}
+
 func (r *remoteCache) UploadFile(file string) {
-	remoteFile := r.blobdir + filepath.Base(file)
-	if err := r.s3.StatFile(remoteFile); err != nil {
-		r.file <- file
+	if err := r.queue.enqueue(file); err != nil {
+		log.WithFields(log.Fields{"local": file}).Errorf("enqueue upload failed, err:%v", err)
+	}
+}
+
+func (r *remoteCache) Reconcile(localDir string) error {
+	remoteFiles, err := r.backend.ListFiles(r.blobdir)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+	enqueued := 0
+	for _, e := range entries {
+		if e.IsDir() || fs.IsTmpFile(e.Name()) || remoteFiles[r.blobdir+e.Name()] {
+			continue
+		}
+		file := filepath.Join(localDir, e.Name())
+		if r.queue.contains(file) {
+			continue
+		}
+		if err = r.queue.enqueue(file); err != nil {
+			return err
+		}
+		enqueued++
+	}
+	log.WithFields(log.Fields{"dir": localDir, "enqueued": enqueued}).Infof("reconciled local blobs with remote cache")
+	return nil
+}
+
+func (r *remoteCache) UploadStats() QueueStats {
+	stats := r.queue.stats()
+	stats.Workers = r.concurrent
+	return stats
+}
+
+// Ping checks that the bucket is reachable with the configured credentials.
+func (r *remoteCache) Ping(ctx context.Context) error {
+	if p, ok := r.backend.(pinger); ok {
+		return p.Ping(ctx)
 	}
+	// a not found answer proves the bucket is reachable as well
+	if err := r.backend.StatFile(ctx, r.blobdir+".ping"); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
 }
 
 func (r *remoteCache) GetRequest(file string) (string, error) {
 	remoteFile := r.blobdir + filepath.Base(file)
-	return r.s3.GetRequest(remoteFile)
+	return r.backend.GetRequest(remoteFile)
 }
 
-func (r *remoteCache) StatFile(file string) error {
+func (r *remoteCache) PresignRequest(file string, expire time.Duration) (string, error) {
+	remoteFile := r.blobdir + filepath.Base(file)
+	return r.backend.Presign(remoteFile, expire)
+}
+
+func (r *remoteCache) Download(ctx context.Context, file string, rng string) (*RemoteObject, error) {
+	remoteFile := r.blobdir + filepath.Base(file)
+	return r.backend.Download(ctx, remoteFile, rng)
+}
+
+func (r *remoteCache) StatFile(ctx context.Context, file string) (err error) {
+	remoteFile := r.blobdir + filepath.Base(file)
+	ctx, span := tracing.Start(ctx, "RemoteCache.StatFile", attribute.String("oss.key", remoteFile))
+	defer func() {
+		span.SetAttributes(attribute.Bool("oss.found", err == nil))
+		span.End()
+	}()
+	return r.backend.StatFile(ctx, remoteFile)
+}
+
+func (r *remoteCache) DeleteFile(file string) error {
+	if err := r.queue.remove(file); err != nil {
+		return err
+	}
 	remoteFile := r.blobdir + filepath.Base(file)
-	return r.s3.StatFile(remoteFile)
+	return r.backend.DeleteFile(remoteFile)
 }
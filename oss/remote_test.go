@@ -0,0 +1,59 @@
+package oss
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// blockingBackend uploads until the upload is aborted.
+type blockingBackend struct {
+	Backend
+	started chan string
+}
+
+func (b *blockingBackend) StatFile(ctx context.Context, key string) error {
+	return ErrNotFound
+}
+
+func (b *blockingBackend) UploadFile(ctx context.Context, localFile, key string) error {
+	b.started <- key
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCloseAbortsUploads(t *testing.T) {
+	backend := &blockingBackend{started: make(chan string, 1)}
+	RegisterBackend("blocking", func(cfg *OssCacheConfig) (Backend, error) { return backend, nil })
+	dir := t.TempDir()
+	cfg := NewOssCacheConfig()
+	cfg.Type = "blocking"
+	cfg.QueuePath = filepath.Join(dir, "queue.db")
+	cfg.Concurrent = 1
+	blob := filepath.Join(dir, "blob")
+	if err := os.WriteFile(blob, []byte("blob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRemoteCache(cfg)
+	r.UploadFile(blob)
+	<-backend.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > abortGrace {
+		t.Errorf("close waited %v for the aborted upload", elapsed)
+	}
+
+	// the aborted upload is retried after a restart, it did not count as an attempt
+	q := openTestQueue(t, cfg.QueuePath, 0)
+	defer q.close()
+	if task := claim(t, q, blob); task.Attempts != 0 {
+		t.Errorf("aborted upload counted %d attempts", task.Attempts)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hf-mirror/proxy"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// runPrefetch implements "hf-mirror prefetch", it starts a prefetch job through
+// the admin api of a running mirror and reports its progress until it finishes.
+func runPrefetch(args []string) int {
+	flags := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	var allow, ignore patternList
+	req := &proxy.PrefetchRequest{}
+	flags.StringVar(&req.Repo, "repo", "", "repo id, e.g. \"meta-llama/Llama-2-7b-hf\"")
+	flags.StringVar(&req.RepoType, "type", "model", "repo type, one of model, dataset or space")
+	flags.StringVar(&req.Revision, "revision", "main", "branch, tag or commit hash")
+	flags.Var(&allow, "allow", "only fetch files matching the pattern, may be repeated")
+	flags.Var(&ignore, "ignore", "skip files matching the pattern, may be repeated")
+	flags.StringVar(&req.Token, "hf-token", os.Getenv("HF_TOKEN"), "hub token used instead of the mirror's service token")
+	admin := flags.String("admin", envOr("HF_MIRROR_ADMIN", "http://127.0.0.1:8083"), "admin api url of the mirror")
+	token := flags.String("token", os.Getenv("HF_MIRROR_ADMIN_TOKEN"), "admin token of the mirror")
+	detach := flags.Bool("detach", false, "print the job id and exit without waiting for the job")
+	flags.Parse(args)
+	if req.Repo == "" {
+		fmt.Fprintln(os.Stderr, "prefetch: -repo is required")
+		flags.Usage()
+		return 2
+	}
+	req.AllowPatterns, req.IgnorePatterns = allow, ignore
+
+	cli := &adminClient{url: strings.TrimSuffix(*admin, "/"), token: *token}
+	body, _ := json.Marshal(req)
+	var job proxy.PrefetchJob
+	if err := cli.do(http.MethodPost, "/admin/prefetch", body, &job); err != nil {
+		fmt.Fprintf(os.Stderr, "prefetch: %v\n", err)
+		return 1
+	}
+	fmt.Printf("prefetch job %v started\n", job.ID)
+	if *detach {
+		return 0
+	}
+	for job.FinishedAt == nil {
+		time.Sleep(time.Second)
+		if err := cli.do(http.MethodGet, "/admin/prefetch/"+job.ID, nil, &job); err != nil {
+			fmt.Fprintf(os.Stderr, "prefetch: %v\n", err)
+			return 1
+		}
+		fmt.Printf("%v: %d/%d files, %d cached, %d failed, %d bytes\n",
+			job.Status, job.Done, job.Files, job.Cached, job.Failed, job.Bytes)
+	}
+	for _, e := range job.Errors {
+		fmt.Fprintln(os.Stderr, e)
+	}
+	if job.Status != proxy.PrefetchDone {
+		fmt.Fprintf(os.Stderr, "prefetch %v: %v\n", job.Status, job.Error)
+		return 1
+	}
+	return 0
+}
+
+func envOr(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
+
+type adminClient struct {
+	url   string
+	token string
+}
+
+func (c *adminClient) do(method, path string, body []byte, res any) error {
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%v %v failed, status:%v, %s", method, path, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
@@ -0,0 +1,428 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hf-mirror/metacache"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+type AdminConfig struct {
+	// Addr is the listener of the admin api, it is disabled when empty.
+	Addr string `yaml:"addr"`
+	// Token must be sent as "Authorization: Bearer {token}" with every admin request.
+	Token string `yaml:"token"`
+	// PrefetchConcurrent is the number of files a prefetch job downloads at a time.
+	PrefetchConcurrent int `yaml:"prefetch_concurrent"`
+}
+
+func NewAdminConfig() *AdminConfig {
+	return &AdminConfig{
+		Addr:  "",
+		Token: "",
+
+		PrefetchConcurrent: 4,
+	}
+}
+
+// adminHandler serves the admin api used to inspect and invalidate the caches:
+//
+//	GET    /admin/repos                                   cached repos and their revisions
+//	GET    /admin/files?repo={repo key}[&revision=]       cached file metadata of a repo
+//	DELETE /admin/revisions?repo={repo key}&revision=     metadata of a revision
+//	GET    /admin/blobs/{etag}                            where a blob is cached and who references it
+//	DELETE /admin/blobs/{etag}                            purge a blob from the local and remote cache
+//	POST   /admin/refetch?repo={repo key}&revision=[&file=][&purge=true]
+//	POST   /admin/prefetch                                start a prefetch job, see PrefetchRequest
+//	GET    /admin/prefetch[/{id}]                         status of the prefetch jobs
+//	DELETE /admin/prefetch/{id}                           cancel a prefetch job
+//
+// repo keys have the form "{models|datasets|spaces}/{repo id}", e.g. "models/gpt2".
+type adminHandler struct {
+	token    string
+	proxy    *hfProxy
+	prefetch *prefetcher
+	mux      *http.ServeMux
+}
+
+// NewAdminHandler returns the admin api of h, which must be created by NewHFProxy.
+func NewAdminHandler(cfg *AdminConfig, h http.Handler) (http.Handler, error) {
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("admin token is not configured")
+	}
+	proxy, ok := h.(*hfProxy)
+	if !ok {
+		return nil, fmt.Errorf("admin api needs a hf proxy handler, got %T", h)
+	}
+	a := &adminHandler{
+		token:    cfg.Token,
+		proxy:    proxy,
+		prefetch: newPrefetcher(proxy, cfg.PrefetchConcurrent),
+		mux:      http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/admin/repos", a.method(http.MethodGet, a.listRepos))
+	a.mux.HandleFunc("/admin/files", a.method(http.MethodGet, a.listFiles))
+	a.mux.HandleFunc("/admin/revisions", a.method(http.MethodDelete, a.deleteRevision))
+	a.mux.HandleFunc("/admin/blobs/", a.blob)
+	a.mux.HandleFunc("/admin/refetch", a.method(http.MethodPost, a.refetch))
+	a.mux.HandleFunc("/admin/prefetch", a.prefetchJobs)
+	a.mux.HandleFunc("/admin/prefetch/", a.prefetchJob)
+	return a, nil
+}
+
+func (a *adminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(requestToken(req)), []byte(a.token)) != 1 {
+		writeAdminError(rw, http.StatusUnauthorized, "invalid admin token")
+		return
+	}
+	a.mux.ServeHTTP(rw, req)
+}
+
+func (a *adminHandler) method(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			rw.Header().Set("Allow", method)
+			writeAdminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(rw, req)
+	}
+}
+
+func writeJson(rw http.ResponseWriter, code int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Warnf("write json response failed, err:%v", err)
+	}
+}
+
+func writeAdminError(rw http.ResponseWriter, code int, msg string) {
+	writeJson(rw, code, map[string]string{"error": msg})
+}
+
+// repoParam parses the repo key of the "repo" query parameter.
+func repoParam(req *http.Request) (*HfFile, error) {
+	key := req.URL.Query().Get("repo")
+	typeSeg, repo, _ := strings.Cut(key, "/")
+	repoType, ok := repoTypePrefixes[typeSeg]
+	if !ok || repo == "" {
+		return nil, fmt.Errorf("invalid repo %q, expected {models|datasets|spaces}/{repo id}", key)
+	}
+	return &HfFile{Type: repoType, Repo: repo}, nil
+}
+
+type adminRevision struct {
+	Revision   string `json:"revision"`
+	CommitHash string `json:"commit_hash"`
+	Files      int    `json:"files"`
+}
+
+type adminRepo struct {
+	Repo      string           `json:"repo"`
+	Revisions []*adminRevision `json:"revisions"`
+}
+
+type adminFile struct {
+	Repo     string                  `json:"repo"`
+	File     string                  `json:"file"`
+	Metadata *metacache.FileMetadata `json:"metadata"`
+}
+
+func (a *adminHandler) listRepos(rw http.ResponseWriter, req *http.Request) {
+	repos := make(map[string]map[string]*adminRevision)
+	a.proxy.metaCache.RangeMetadata(func(project, file string, metas []*metacache.FileMetadata) bool {
+		revisions := repos[project]
+		if revisions == nil {
+			revisions = make(map[string]*adminRevision)
+			repos[project] = revisions
+		}
+		for _, meta := range metas {
+			rev := revisions[meta.Tag]
+			if rev == nil {
+				rev = &adminRevision{Revision: meta.Tag, CommitHash: meta.CommitHash}
+				revisions[meta.Tag] = rev
+			}
+			rev.Files++
+		}
+		return true
+	})
+	res := make([]*adminRepo, 0, len(repos))
+	for project, revisions := range repos {
+		repo := &adminRepo{Repo: project}
+		for _, rev := range revisions {
+			repo.Revisions = append(repo.Revisions, rev)
+		}
+		sort.Slice(repo.Revisions, func(i, j int) bool { return repo.Revisions[i].Revision < repo.Revisions[j].Revision })
+		res = append(res, repo)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Repo < res[j].Repo })
+	writeJson(rw, http.StatusOK, res)
+}
+
+// revisionFiles returns the cached metadata of project, only that of revision when it is set.
+func (a *adminHandler) revisionFiles(project, revision string) []*adminFile {
+	var files []*adminFile
+	a.proxy.metaCache.RangeMetadata(func(p, file string, metas []*metacache.FileMetadata) bool {
+		if p != project {
+			return true
+		}
+		for _, meta := range metas {
+			if revision == "" || meta.Tag == revision || meta.CommitHash == revision {
+				files = append(files, &adminFile{Repo: p, File: file, Metadata: meta})
+			}
+		}
+		return true
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].File < files[j].File })
+	return files
+}
+
+func (a *adminHandler) listFiles(rw http.ResponseWriter, req *http.Request) {
+	f, err := repoParam(req)
+	if err != nil {
+		writeAdminError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	files := a.revisionFiles(f.RepoKey(), req.URL.Query().Get("revision"))
+	if files == nil {
+		files = []*adminFile{}
+	}
+	writeJson(rw, http.StatusOK, files)
+}
+
+func (a *adminHandler) deleteRevision(rw http.ResponseWriter, req *http.Request) {
+	f, err := repoParam(req)
+	if err != nil {
+		writeAdminError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	revision := req.URL.Query().Get("revision")
+	if revision == "" {
+		writeAdminError(rw, http.StatusBadRequest, "revision is required")
+		return
+	}
+	project := f.RepoKey()
+	files := a.proxy.metaCache.DeleteMetadata(project, revision)
+	// the ref of a branch or tag and the responses of a commit
+	apis := a.proxy.metaCache.DeleteApiResponses(func(key string) bool {
+		return key == "ref_"+project+"@"+revision || strings.Contains(key, "_"+project+"@"+revision+"/")
+	})
+	log.WithFields(log.Fields{"repo": project, "revision": revision, "files": files, "apis": apis}).
+		Infof("admin deleted revision metadata")
+	writeJson(rw, http.StatusOK, map[string]int{"files": files, "apis": apis})
+}
+
+type adminBlob struct {
+	Etag        string               `json:"etag"`
+	Local       bool                 `json:"local"`
+	Size        int64                `json:"size,omitempty"`
+	Downloading bool                 `json:"downloading"`
+	Remote      bool                 `json:"remote"`
+	Owner       *metacache.BlobOwner `json:"owner,omitempty"`
+	Files       []*adminFile         `json:"files"`
+}
+
+func (a *adminHandler) blob(rw http.ResponseWriter, req *http.Request) {
+	etag := strings.TrimPrefix(req.URL.Path, "/admin/blobs/")
+	// etags name files of the cache dir
+	if etag == "" || strings.ContainsAny(etag, "/\\") || strings.HasPrefix(etag, ".") {
+		writeAdminError(rw, http.StatusNotFound, "invalid blob etag")
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		a.lookupBlob(rw, etag)
+	case http.MethodDelete:
+		a.purgeBlob(rw, etag)
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		writeAdminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *adminHandler) lookupBlob(rw http.ResponseWriter, etag string) {
+	h := a.proxy
+	res := &adminBlob{
+		Etag:  etag,
+		Owner: h.metaCache.GetBlobOwner(etag),
+		Files: []*adminFile{},
+	}
+	filePath := h.fileCache.GetFilePath(etag)
+	if info, err := os.Stat(filePath); err == nil {
+		res.Local = true
+		res.Size = info.Size()
+	}
+	if rd, _, ok := h.fileCache.OpenDownloading(etag); ok {
+		rd.Close()
+		res.Downloading = true
+	}
+	res.Remote = h.remoteCache.StatFile(context.Background(), filePath) == nil
+	h.metaCache.RangeMetadata(func(project, file string, metas []*metacache.FileMetadata) bool {
+		for _, meta := range metas {
+			if meta.Etag == etag {
+				res.Files = append(res.Files, &adminFile{Repo: project, File: file, Metadata: meta})
+			}
+		}
+		return true
+	})
+	if !res.Local && !res.Downloading && !res.Remote && len(res.Files) == 0 {
+		writeAdminError(rw, http.StatusNotFound, "blob is not cached")
+		return
+	}
+	writeJson(rw, http.StatusOK, res)
+}
+
+// purge removes the blob of etag from the local and the remote cache, a running
+// download of it is discarded and its pending upload dropped.
+func (h *hfProxy) purge(etag string) error {
+	if err := h.fileCache.Remove(etag); err != nil {
+		return fmt.Errorf("failed to remove local blob %v, %v", etag, err)
+	}
+	if err := h.remoteCache.DeleteFile(h.fileCache.GetFilePath(etag)); err != nil {
+		return fmt.Errorf("failed to remove remote blob %v, %v", etag, err)
+	}
+	log.WithFields(log.Fields{"etag": etag}).Infof("blob purged from cache")
+	return nil
+}
+
+func (a *adminHandler) purgeBlob(rw http.ResponseWriter, etag string) {
+	if err := a.proxy.purge(etag); err != nil {
+		writeAdminError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// refetch resolves the cached files of a revision, or just the given file,
+// from upstream again and downloads their blobs in the background. With purge
+// the blobs they resolved to so far are removed first.
+func (a *adminHandler) refetch(rw http.ResponseWriter, req *http.Request) {
+	h := a.proxy
+	if h.offline {
+		writeAdminError(rw, http.StatusConflict, "refetch is not possible in offline mode")
+		return
+	}
+	repo, err := repoParam(req)
+	if err != nil {
+		writeAdminError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := req.URL.Query()
+	revision := query.Get("revision")
+	if revision == "" {
+		writeAdminError(rw, http.StatusBadRequest, "revision is required")
+		return
+	}
+	var paths []string
+	etags := make(map[string]bool)
+	if file := query.Get("file"); file != "" {
+		paths = append(paths, file)
+		if meta := h.metaCache.SearchMetaData(repo.RepoKey(), file, revision); meta != nil {
+			etags[meta.Etag] = true
+		}
+	} else {
+		seen := make(map[string]bool)
+		for _, f := range a.revisionFiles(repo.RepoKey(), revision) {
+			if !seen[f.File] {
+				seen[f.File] = true
+				paths = append(paths, f.File)
+			}
+			etags[f.Metadata.Etag] = true
+		}
+	}
+	if len(paths) == 0 {
+		writeAdminError(rw, http.StatusNotFound, "revision is not cached, pass the file to fetch")
+		return
+	}
+	if query.Get("purge") == "true" {
+		for etag := range etags {
+			if err = h.purge(etag); err != nil {
+				writeAdminError(rw, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
+
+	var res []*adminFile
+	for _, p := range paths {
+		f := &HfFile{Type: repo.Type, Repo: repo.Repo, Revision: revision, Path: p}
+		token := h.auth.serviceToken(f)
+		meta := h.fetchFileMeta(req.Context(), f, token)
+		if meta.Etag == "" {
+			log.WithFields(f.LogFields()).Warnf("admin refetch could not resolve file")
+			continue
+		}
+		res = append(res, &adminFile{Repo: f.RepoKey(), File: p, Metadata: &meta})
+		fileUrl, etag := h.hub.fileUrl(f), meta.Etag
+		h.fill(etag, func(ctx context.Context) error {
+			_, err := h.fetchBlob(ctx, fileUrl, bearer(token), etag)
+			return err
+		})
+	}
+	if res == nil {
+		writeAdminError(rw, http.StatusBadGateway, "no file could be resolved upstream")
+		return
+	}
+	log.WithFields(log.Fields{"repo": repo.RepoKey(), "revision": revision, "files": len(res)}).Infof("admin refetch started")
+	writeJson(rw, http.StatusAccepted, res)
+}
+
+func (a *adminHandler) prefetchJobs(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJson(rw, http.StatusOK, a.prefetch.list())
+	case http.MethodPost:
+		if a.proxy.offline {
+			writeAdminError(rw, http.StatusConflict, "prefetch is not possible in offline mode")
+			return
+		}
+		var preq PrefetchRequest
+		if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&preq); err != nil {
+			writeAdminError(rw, http.StatusBadRequest, "invalid prefetch request, "+err.Error())
+			return
+		}
+		job, err := a.prefetch.start(&preq)
+		if err == errShuttingDown {
+			writeAdminError(rw, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if err != nil {
+			writeAdminError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJson(rw, http.StatusAccepted, job)
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		writeAdminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *adminHandler) prefetchJob(rw http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/admin/prefetch/")
+	switch req.Method {
+	case http.MethodGet:
+		job, ok := a.prefetch.get(id)
+		if !ok {
+			writeAdminError(rw, http.StatusNotFound, "prefetch job not found")
+			return
+		}
+		writeJson(rw, http.StatusOK, job)
+	case http.MethodDelete:
+		if !a.prefetch.cancel(id) {
+			writeAdminError(rw, http.StatusNotFound, "prefetch job not found")
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		writeAdminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
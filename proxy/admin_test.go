@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"hf-mirror/fs"
+	"hf-mirror/metacache"
+	"hf-mirror/oss"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "secret"
+
+type adminTestEnv struct {
+	proxy *hfProxy
+	admin http.Handler
+}
+
+// newAdminTestEnv serves the admin api of a proxy with a posix remote cache in
+// front of the hub at hubEndpoint.
+func newAdminTestEnv(t *testing.T, hubEndpoint string) *adminTestEnv {
+	dir := t.TempDir()
+	metaCfg := metacache.NewMetaConfig()
+	metaCfg.Shards = 16
+	metaCfg.OwnersPath = filepath.Join(dir, "owners.db")
+	metaCache := metacache.NewMetaDataCache(metaCfg)
+	t.Cleanup(func() { metaCache.Close() })
+
+	localCfg := fs.NewConfig()
+	localCfg.CacheDir = filepath.Join(dir, "blobs")
+	if err := os.MkdirAll(localCfg.CacheDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	remoteCfg := oss.NewOssCacheConfig()
+	remoteCfg.Type = oss.BackendPosix
+	remoteCfg.Posix.Dir = filepath.Join(dir, "bucket")
+	remoteCfg.QueuePath = filepath.Join(dir, "queue.db")
+	remoteCfg.Concurrent = 1
+	remoteCache := oss.NewRemoteCache(remoteCfg)
+	t.Cleanup(func() { remoteCache.Close(context.Background()) })
+
+	cfg := NewConfig()
+	cfg.HubEndpoint = hubEndpoint
+	cfg.LfsEndpoints = nil
+	h := NewHFProxy(cfg, metaCache, fs.NewFileCache(localCfg), remoteCache)
+	adminCfg := NewAdminConfig()
+	adminCfg.Token = testAdminToken
+	admin, err := NewAdminHandler(adminCfg, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &adminTestEnv{proxy: h.(*hfProxy), admin: admin}
+}
+
+func (e *adminTestEnv) do(method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rw := httptest.NewRecorder()
+	e.admin.ServeHTTP(rw, req)
+	return rw
+}
+
+// writeBlob starts a download of etag into the local cache, the blob is
+// committed once the returned writer is closed.
+func (e *adminTestEnv) writeBlob(t *testing.T, etag string, data []byte, upload bool) func() {
+	w, err := e.proxy.fileCache.CreateBlobWriter(etag, int64(len(data)), func() {
+		if upload {
+			e.proxy.remoteCache.UploadFile(e.proxy.fileCache.GetFilePath(etag))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitUploads waits until the upload queue is drained.
+func (e *adminTestEnv) waitUploads(t *testing.T) {
+	deadline := time.Now().Add(time.Second * 10)
+	for stats := e.proxy.remoteCache.UploadStats(); stats.Pending > 0 || stats.Inflight > 0; stats = e.proxy.remoteCache.UploadStats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("uploads did not finish, stats %+v", stats)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	if _, err := NewAdminHandler(NewAdminConfig(), &hfProxy{}); err == nil {
+		t.Error("admin api started without a token")
+	}
+	env := newAdminTestEnv(t, "http://127.0.0.1:1")
+	cases := []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{testAdminToken, http.StatusOK},
+	}
+	for _, c := range cases {
+		if rw := env.do(http.MethodGet, "/admin/repos", c.token); rw.Code != c.code {
+			t.Errorf("token %q: status %v, want %v", c.token, rw.Code, c.code)
+		}
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	env := newAdminTestEnv(t, "http://127.0.0.1:1")
+	h := env.proxy
+	env.writeBlob(t, "cached", []byte("cached blob"), true)()
+	env.waitUploads(t)
+	finish := env.writeBlob(t, "downloading", []byte("downloading blob"), true)
+
+	for _, etag := range []string{"cached", "downloading"} {
+		if rw := env.do(http.MethodDelete, "/admin/blobs/"+etag, testAdminToken); rw.Code != http.StatusNoContent {
+			t.Fatalf("purge %v: status %v, %v", etag, rw.Code, rw.Body)
+		}
+	}
+	if h.fileCache.HasFile("cached") {
+		t.Error("purged blob still cached locally")
+	}
+	if err := h.remoteCache.StatFile(context.Background(), h.fileCache.GetFilePath("cached")); !errors.Is(err, oss.ErrNotFound) {
+		t.Errorf("purged blob still cached remotely, err:%v", err)
+	}
+	if rd, _, ok := h.fileCache.OpenDownloading("downloading"); ok {
+		rd.Close()
+		t.Error("purged download still followed")
+	}
+
+	// the download that was running during the purge is not committed
+	finish()
+	env.waitUploads(t)
+	if h.fileCache.HasFile("downloading") {
+		t.Error("purged download committed")
+	}
+	if err := h.remoteCache.StatFile(context.Background(), h.fileCache.GetFilePath("downloading")); !errors.Is(err, oss.ErrNotFound) {
+		t.Errorf("purged download uploaded, err:%v", err)
+	}
+	if rw := env.do(http.MethodGet, "/admin/blobs/cached", testAdminToken); rw.Code != http.StatusNotFound {
+		t.Errorf("lookup of a purged blob: status %v, %v", rw.Code, rw.Body)
+	}
+}
+
+func TestAdminRefetch(t *testing.T) {
+	blob := []byte("fresh weights")
+	hub := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/org/model/resolve/main/model.bin" {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set(HUGGINGFACE_HEADER_X_REPO_COMMIT, "c2")
+		rw.Header().Set("ETag", `"fresh"`)
+		rw.Write(blob)
+	}))
+	defer hub.Close()
+	env := newAdminTestEnv(t, hub.URL)
+	h := env.proxy
+	f := &HfFile{Type: RepoTypeModel, Repo: "org/model", Revision: "main", Path: "model.bin"}
+	h.storeFileMeta(f, &metacache.FileMetadata{Tag: "main", CommitHash: "c1", Etag: "stale", Location: hub.URL})
+	env.writeBlob(t, "stale", []byte("stale weights"), false)()
+
+	if rw := env.do(http.MethodPost, "/admin/refetch?repo=models/org/model&revision=main", "wrong"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("refetch with a wrong token: status %v", rw.Code)
+	}
+	if rw := env.do(http.MethodPost, "/admin/refetch?repo=models/org/other&revision=main", testAdminToken); rw.Code != http.StatusNotFound {
+		t.Errorf("refetch of an uncached revision: status %v", rw.Code)
+	}
+	rw := env.do(http.MethodPost, "/admin/refetch?repo=models/org/model&revision=main&purge=true", testAdminToken)
+	if rw.Code != http.StatusAccepted {
+		t.Fatalf("refetch: status %v, %v", rw.Code, rw.Body)
+	}
+	if h.fileCache.HasFile("stale") {
+		t.Error("blob of the old metadata not purged")
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for !h.fileCache.HasFile("fresh") {
+		if time.Now().After(deadline) {
+			t.Fatal("refetched blob not downloaded")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if meta := h.metaCache.SearchMetaData(f.RepoKey(), f.Path, "main"); meta == nil || meta.Etag != "fresh" {
+		t.Errorf("metadata not refreshed, got %+v", meta)
+	}
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"hf-mirror/accesslog"
+	"hf-mirror/metacache"
+	"hf-mirror/metrics"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	apiKindInfo     = "info"
+	apiKindRevision = "revision"
+	apiKindTree     = "tree"
+
+	// maxApiBodySize bounds the api responses kept in the meta cache.
+	maxApiBodySize = 32 << 20
+)
+
+// HfApiRequest is a hub json api call the mirror caches, as addressed by
+// {hub}/api/{models|datasets|spaces}/{repo id}[/revision/{revision}] or
+// {hub}/api/{models|datasets|spaces}/{repo id}/tree/{revision}[/{path}].
+type HfApiRequest struct {
+	Type RepoType
+	Repo string
+	Kind string
+	// Revision is unescaped, empty for the default branch.
+	Revision string
+	Path     string
+	RawQuery string
+}
+
+func (a *HfApiRequest) repoFile() *HfFile {
+	return &HfFile{
+		Type:     a.Type,
+		Repo:     a.Repo,
+		Revision: a.Revision,
+	}
+}
+
+func (a *HfApiRequest) LogFields() log.Fields {
+	return log.Fields{
+		"repo_type": a.Type,
+		"repo":      a.Repo,
+		"revision":  a.Revision,
+		"api":       a.Kind,
+		"path":      a.Path,
+	}
+}
+
+func (a *HfApiRequest) refKey() string {
+	return "ref_" + a.repoFile().RepoKey() + "@" + a.Revision
+}
+
+func (a *HfApiRequest) responseKey(commitHash string) string {
+	return a.Kind + "_" + a.repoFile().RepoKey() + "@" + commitHash + "/" + a.Path + "?" + a.RawQuery
+}
+
+func parseHfApiRequest(escapedPath, rawQuery string) *HfApiRequest {
+	if !strings.HasPrefix(escapedPath, "/api/") {
+		return nil
+	}
+	escapedPath = strings.TrimPrefix(escapedPath, "/api/")
+	typeSeg, _, _ := strings.Cut(escapedPath, "/")
+	if _, ok := repoTypePrefixes[typeSeg]; !ok {
+		return nil
+	}
+	for _, kind := range []string{apiKindRevision, apiKindTree} {
+		repoType, repo, rest, ok := parseRepoPath(escapedPath, kind)
+		if !ok || len(rest) == 0 {
+			continue
+		}
+		revision, err := url.PathUnescape(rest[0])
+		if err != nil {
+			return nil
+		}
+		a := &HfApiRequest{
+			Type:     repoType,
+			Repo:     repo,
+			Kind:     kind,
+			Revision: revision,
+			RawQuery: rawQuery,
+		}
+		if kind == apiKindTree {
+			if a.Path, err = url.PathUnescape(strings.Join(rest[1:], "/")); err != nil {
+				return nil
+			}
+		} else if len(rest) > 1 {
+			return nil
+		}
+		return a
+	}
+	segs := strings.Split(strings.Trim(escapedPath, "/"), "/")[1:]
+	if len(segs) == 0 || len(segs) > 2 {
+		return nil
+	}
+	repo, err := url.PathUnescape(strings.Join(segs, "/"))
+	if err != nil {
+		return nil
+	}
+	return &HfApiRequest{
+		Type:     repoTypePrefixes[typeSeg],
+		Repo:     repo,
+		Kind:     apiKindInfo,
+		RawQuery: rawQuery,
+	}
+}
+
+// apiCommit resolves the commit hash an api request is keyed by, refs older
+// than revalidateAfter are not trusted unless the mirror is offline.
+func (h *hfProxy) apiCommit(a *HfApiRequest) string {
+	if metacache.IsCommitHash(a.Revision) {
+		return a.Revision
+	}
+	ref := h.metaCache.GetApiResponse(a.refKey())
+	if ref == nil || (!h.offline && ref.Stale(h.revalidateAfter)) {
+		return ""
+	}
+	return ref.CommitHash
+}
+
+// serveCachedApi answers a hub api call from the meta cache, false is returned on a miss.
+func (h *hfProxy) serveCachedApi(rw http.ResponseWriter, req *http.Request, a *HfApiRequest) bool {
+	accesslog.FromContext(req.Context()).SetFile(string(a.Type), a.Repo, a.Revision, a.Path)
+	commitHash := h.apiCommit(a)
+	var res *metacache.ApiResponse
+	if commitHash != "" {
+		res = h.metaCache.GetApiResponse(a.responseKey(commitHash))
+	}
+	metrics.Hit("api", res != nil)
+	if res == nil {
+		return false
+	}
+	if res.Private && !h.auth.allowedUrl(req, a.repoFile(), h.hub.apiUrl(a)) {
+		writeGatedError(rw, a.repoFile().RepoKey())
+		return true
+	}
+	if res.ContentType != "" {
+		rw.Header().Set("Content-Type", res.ContentType)
+	}
+	if res.Link != "" {
+		rw.Header().Set("Link", res.Link)
+	}
+	rw.Header().Set(HUGGINGFACE_HEADER_X_REPO_COMMIT, commitHash)
+	accesslog.FromContext(req.Context()).SetTier(metrics.TierMeta)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(res.Body)
+	log.WithFields(a.LogFields()).Infof("api response hit cache")
+	return true
+}
+
+type apiBody struct {
+	Sha string `json:"sha"`
+}
+
+// storeApiResponse stores a successful api response in the meta cache keyed by
+// the commit hash it was resolved at, once it was streamed to the client.
+func (h *hfProxy) storeApiResponse(a *HfApiRequest, response *http.Response) {
+	h.rewriteLink(response)
+	res := &metacache.ApiResponse{
+		CommitHash:  response.Header.Get(HUGGINGFACE_HEADER_X_REPO_COMMIT),
+		ContentType: response.Header.Get("Content-Type"),
+		Link:        response.Header.Get("Link"),
+	}
+	token := requestToken(response.Request)
+	response.Body = &apiTee{ReadCloser: response.Body, store: func(body []byte) {
+		res.Body = body
+		h.goBackground(func(context.Context) {
+			h.cacheApiResponse(a, res, token)
+		})
+	}}
+}
+
+// cacheApiResponse resolves the commit hash and privacy of the api response res
+// read with token and stores it.
+func (h *hfProxy) cacheApiResponse(a *HfApiRequest, res *metacache.ApiResponse, token string) {
+	if a.Kind != apiKindTree {
+		var info apiBody
+		if err := json.Unmarshal(res.Body, &info); err == nil && info.Sha != "" {
+			res.CommitHash = info.Sha
+		}
+	}
+	if res.CommitHash == "" {
+		res.CommitHash = h.apiCommit(a)
+	}
+	if res.CommitHash == "" {
+		log.WithFields(a.LogFields()).Warnf("api response has no resolvable commit, skip caching")
+		return
+	}
+	res.Private = h.auth.isPrivate(a.repoFile(), h.hub.apiUrl(a), token)
+	h.metaCache.SetApiResponse(a.responseKey(res.CommitHash), res)
+	if !metacache.IsCommitHash(a.Revision) {
+		h.metaCache.SetApiResponse(a.refKey(), &metacache.ApiResponse{CommitHash: res.CommitHash})
+	}
+}
+
+// rewriteLink points pagination links of the hub api at the mirror.
+func (h *hfProxy) rewriteLink(response *http.Response) {
+	if link := response.Header.Get("Link"); link != "" {
+		response.Header.Set("Link", strings.ReplaceAll(link, "<"+h.hub.endpoint, "<"+h.proxyUrl+h.hub.endpoint))
+	}
+}
+
+// apiTee keeps a copy of the api response read from it, store is called with
+// it once the body was read to its end within maxApiBodySize.
+type apiTee struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	over  bool
+	store func(body []byte)
+}
+
+func (t *apiTee) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if !t.over {
+		if t.buf.Len()+n > maxApiBodySize {
+			t.over = true
+			t.buf = bytes.Buffer{}
+		} else {
+			t.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !t.over && t.store != nil {
+		t.store(t.buf.Bytes())
+		t.store = nil
+	}
+	return n, err
+}
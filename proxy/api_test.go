@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestApiResponseCachedOnceStreamed(t *testing.T) {
+	var probes int32
+	body := `{"id":"org/private","sha":"` + strings.Repeat("a", 40) + `"}`
+	hub := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") == "" {
+			atomic.AddInt32(&probes, 1)
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(body))
+	}))
+	defer hub.Close()
+	env := newAdminTestEnv(t, hub.URL)
+	h := env.proxy
+
+	for _, revision := range []string{"main", "dev"} {
+		a := &HfApiRequest{Type: RepoTypeModel, Repo: "org/private", Kind: apiKindRevision, Revision: revision}
+		req := httptest.NewRequest(http.MethodGet, "/"+hub.URL+"/api/models/org/private/revision/"+revision, nil)
+		req.Header.Set("Authorization", "Bearer hf_user")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK || rw.Body.String() != body {
+			t.Fatalf("%v: status %v, body %q", revision, rw.Code, rw.Body)
+		}
+		deadline := time.Now().Add(time.Second * 10)
+		for h.apiCommit(a) == "" {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v: api response not cached", revision)
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		res := h.metaCache.GetApiResponse(a.responseKey(h.apiCommit(a)))
+		if res == nil || string(res.Body) != body || !res.Private {
+			t.Fatalf("%v: unexpected cached response %+v", revision, res)
+		}
+	}
+	// the anonymous access of the repo is probed once
+	if n := atomic.LoadInt32(&probes); n != 1 {
+		t.Errorf("probed anonymous access %d times", n)
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/allegro/bigcache"
+	log "github.com/sirupsen/logrus"
+	"hf-mirror/metacache"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const HUGGINGFACE_ERROR_GATED_REPO = "GatedRepo"
+
+// Credential is a service token injected upstream for repos matching Pattern
+// when the client did not send one itself, Pattern uses path.Match syntax on the
+// repo id, e.g. "meta-llama/*".
+type Credential struct {
+	Pattern string `yaml:"pattern"`
+	Token   string `yaml:"token"`
+}
+
+type authorizer struct {
+	credentials []*Credential
+	hgClient    *HGClient
+	decisions   *metacache.LocalCache[bool]
+	offline     bool
+}
+
+func newAuthorizer(credentials []*Credential, hgClient *HGClient, offline bool) *authorizer {
+	decisions, err := metacache.NewLocalCache[bool](&bigcache.Config{
+		Shards:             64,
+		LifeWindow:         time.Minute * 10,
+		CleanWindow:        time.Minute,
+		MaxEntriesInWindow: 1000,
+		MaxEntrySize:       64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return &authorizer{
+		credentials: credentials,
+		hgClient:    hgClient,
+		decisions:   decisions,
+		offline:     offline,
+	}
+}
+
+func requestToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// serviceToken returns the configured token for the repo of f, if any.
+func (a *authorizer) serviceToken(f *HfFile) string {
+	for _, c := range a.credentials {
+		if ok, _ := path.Match(c.Pattern, f.Repo); ok {
+			return c.Token
+		}
+	}
+	return ""
+}
+
+// token returns the token used upstream on behalf of req, the client's own
+// token takes precedence over a configured service token.
+func (a *authorizer) token(req *http.Request, f *HfFile) string {
+	if t := requestToken(req); t != "" {
+		return t
+	}
+	return a.serviceToken(f)
+}
+
+// bearer returns the Authorization header value of token, empty for no token.
+func bearer(token string) string {
+	if token == "" {
+		return ""
+	}
+	return "Bearer " + token
+}
+
+// injectToken sets the service token on a request to the hub that carries none.
+func (a *authorizer) injectToken(req *http.Request, f *HfFile) {
+	if req.Header.Get("Authorization") != "" {
+		return
+	}
+	if t := a.serviceToken(f); t != "" {
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+}
+
+// isGated probes anonymous access to a file that was resolved with token,
+// files resolved anonymously are never gated.
+func (a *authorizer) isGated(f *HfFile, token string) bool {
+	if token == "" {
+		return false
+	}
+	ok, err := a.hgClient.Authorized(f, "")
+	if err != nil {
+		// be conservative, an unverifiable file is treated as gated
+		log.WithFields(f.LogFields()).Warnf("probe anonymous access failed, err:%v", err)
+		return true
+	}
+	return !ok
+}
+
+// isPrivate reports whether the repo of f, whose probeUrl was read with token,
+// can't be read anonymously. Anonymous decisions are cached per repo like the
+// ones of allowedUrl.
+func (a *authorizer) isPrivate(f *HfFile, probeUrl, token string) bool {
+	if token == "" {
+		return false
+	}
+	key := "anonymous_" + f.RepoKey()
+	if ok := a.decisions.Get(key); ok != nil {
+		return !*ok
+	}
+	ok, err := a.hgClient.CanRead(probeUrl, "")
+	if err != nil {
+		// be conservative, an unverifiable repo is treated as private
+		log.WithFields(f.LogFields()).Warnf("probe anonymous access failed, err:%v", err)
+		return true
+	}
+	a.decisions.Set(key, &ok)
+	return !ok
+}
+
+// allowed checks that req may read the file described by owner.
+func (a *authorizer) allowed(req *http.Request, owner *metacache.BlobOwner) bool {
+	f := hfFileFromOwner(owner)
+	return a.allowedUrl(req, f, a.hgClient.hub.fileUrl(f))
+}
+
+// allowedUrl checks that req may read probeUrl of the repo of f, decisions are
+// cached per token and repo for the decision cache life window. In offline mode
+// only cached decisions are honoured.
+func (a *authorizer) allowedUrl(req *http.Request, f *HfFile, probeUrl string) bool {
+	token := a.token(req, f)
+	if token == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:]) + "_" + f.RepoKey()
+	if ok := a.decisions.Get(key); ok != nil {
+		return *ok
+	}
+	if a.offline {
+		return false
+	}
+	ok, err := a.hgClient.CanRead(probeUrl, token)
+	if err != nil {
+		log.WithFields(f.LogFields()).Errorf("verify gated repo access failed, err:%v", err)
+		return false
+	}
+	a.decisions.Set(key, &ok)
+	return ok
+}
+
+func writeGatedError(rw http.ResponseWriter, repo string) {
+	writeHfError(rw, http.StatusForbidden, HUGGINGFACE_ERROR_GATED_REPO,
+		"Access to repo "+repo+" is restricted, you must be authenticated and authorized to access it.")
+}
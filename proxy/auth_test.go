@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"hf-mirror/metacache"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func newAccessTestProxy(t *testing.T, cfg *metacache.MetaConfig) *hfProxy {
+	hub, err := newHubUrls("https://huggingface.co", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := metacache.NewMetaDataCache(cfg)
+	t.Cleanup(func() { m.Close() })
+	return &hfProxy{
+		hub:       hub,
+		metaCache: m,
+		auth:      newAuthorizer(nil, NewHGClient(hub), false),
+	}
+}
+
+func newAccessTestConfig(t *testing.T) *metacache.MetaConfig {
+	cfg := metacache.NewMetaConfig()
+	cfg.Shards = 16
+	cfg.OwnersPath = filepath.Join(t.TempDir(), "owners.db")
+	return cfg
+}
+
+func TestCheckBlobAccess(t *testing.T) {
+	h := newAccessTestProxy(t, newAccessTestConfig(t))
+	gated := &HfFile{Type: RepoTypeModel, Repo: "org/gated", Revision: "main", Path: "model.bin"}
+	public := &HfFile{Type: RepoTypeModel, Repo: "org/public", Revision: "main", Path: "model.bin"}
+	h.storeFileMeta(gated, &metacache.FileMetadata{Etag: "gated", CommitHash: "c1", Gated: true})
+	h.storeFileMeta(public, &metacache.FileMetadata{Etag: "public", CommitHash: "c2"})
+
+	cases := []struct {
+		etag   string
+		access blobAccess
+		code   int
+	}{
+		{"gated", blobDenied, http.StatusForbidden},
+		{"public", blobAllowed, http.StatusOK},
+		{"unknown", blobUnknown, http.StatusOK},
+	}
+	for _, c := range cases {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if access := h.checkBlobAccess(rw, req, c.etag); access != c.access || rw.Code != c.code {
+			t.Errorf("%v: got access %v code %v, want %v %v", c.etag, access, rw.Code, c.access, c.code)
+		}
+	}
+}
+
+func TestPublicBlobOwnerIsNotDowngraded(t *testing.T) {
+	h := newAccessTestProxy(t, newAccessTestConfig(t))
+	public := &HfFile{Type: RepoTypeModel, Repo: "org/public", Revision: "main", Path: "model.bin"}
+	gated := &HfFile{Type: RepoTypeModel, Repo: "org/gated", Revision: "main", Path: "copy.bin"}
+	h.storeFileMeta(public, &metacache.FileMetadata{Etag: "shared", CommitHash: "c1"})
+	h.storeFileMeta(gated, &metacache.FileMetadata{Etag: "shared", CommitHash: "c2", Gated: true})
+	if owner := h.metaCache.GetBlobOwner("shared"); owner == nil || !owner.Public {
+		t.Fatalf("public blob became gated: %+v", owner)
+	}
+}
+
+func TestGatedBlobDeniedAfterRestart(t *testing.T) {
+	cfg := newAccessTestConfig(t)
+	h := newAccessTestProxy(t, cfg)
+	gated := &HfFile{Type: RepoTypeModel, Repo: "org/gated", Revision: "main", Path: "model.bin"}
+	h.storeFileMeta(gated, &metacache.FileMetadata{Etag: "gated", CommitHash: "c1", Gated: true})
+	h.metaCache.Close()
+
+	h = newAccessTestProxy(t, cfg)
+	rw := httptest.NewRecorder()
+	if access := h.checkBlobAccess(rw, httptest.NewRequest(http.MethodGet, "/", nil), "gated"); access != blobDenied {
+		t.Fatalf("anonymous access to gated blob after restart: %v", access)
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hf-mirror/metrics"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// flight is an upstream download of a blob that later requesters of the same
+// etag wait for, ready is closed once its local blob writer exists or the
+// download turned out not to be cacheable.
+type flight struct {
+	ready chan struct{}
+	once  sync.Once
+}
+
+func (f *flight) release() {
+	f.once.Do(func() { close(f.ready) })
+}
+
+type flightGroup struct {
+	mux     sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		flights: make(map[string]*flight),
+	}
+}
+
+// join returns the flight of etag, leader is true when the caller started it
+// and has to download the blob.
+func (g *flightGroup) join(etag string) (f *flight, leader bool) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if f, ok := g.flights[etag]; ok {
+		return f, false
+	}
+	f = &flight{ready: make(chan struct{})}
+	g.flights[etag] = f
+	return f, true
+}
+
+// release wakes up the requesters waiting for the flight of etag.
+func (g *flightGroup) release(etag string) {
+	g.mux.Lock()
+	f, ok := g.flights[etag]
+	delete(g.flights, etag)
+	g.mux.Unlock()
+	if ok {
+		f.release()
+	}
+}
+
+// serveDownloading streams a blob that is still being downloaded from its growing
+// tmp file, the bytes are counted as served by tier.
+func (h *hfProxy) serveDownloading(rw http.ResponseWriter, req *http.Request, etag, tier string) bool {
+	rd, size, ok := h.fileCache.OpenDownloading(etag)
+	if !ok {
+		return false
+	}
+	defer rd.Close()
+	log.WithFields(log.Fields{"etag": etag}).Infof("file download joins in-progress download")
+	rw = serveBlob(rw, req, tier)
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	rw.Header().Set("ETag", fmt.Sprintf("\"%s\"", etag))
+	rw.Header().Set("Accept-Ranges", "bytes")
+	rw.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(rw, rd); err != nil {
+		log.WithFields(log.Fields{"etag": etag}).Warnf("follow in-progress download failed, err:%v", err)
+	}
+	return true
+}
+
+// coalesce serves a full download of etag from the tmp file of a background
+// fill, the first requester starts the fill with fetch and follows it like any
+// later requester, so the download does not depend on any one client. It returns
+// false when the blob could not be filled, e.g. the source refused it or did not
+// respond within the coalesce wait, the caller serves the request itself then.
+func (h *hfProxy) coalesce(rw http.ResponseWriter, req *http.Request, etag, tier string, fetch func(ctx context.Context) error) bool {
+	if h.serveDownloading(rw, req, etag, metrics.TierLocal) {
+		return true
+	}
+	f, leader := h.fill(etag, fetch)
+	if f != nil {
+		timer := time.NewTimer(h.coalesceWait)
+		defer timer.Stop()
+		select {
+		case <-f.ready:
+		case <-timer.C:
+		case <-req.Context().Done():
+			return true
+		}
+	}
+	if !leader {
+		tier = metrics.TierLocal
+	}
+	return h.serveDownloading(rw, req, etag, tier) || h.serveLocalFile(rw, req, etag)
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// abortGrace is how long Shutdown waits for aborted background work to return.
+const abortGrace = 5 * time.Second
+
+// newFillTransport bounds how long a fill waits for upstream to connect and
+// answer, the body may take as long as the blob needs.
+func newFillTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: time.Second * 10, KeepAlive: time.Second * 30}).DialContext
+	t.TLSHandshakeTimeout = time.Second * 10
+	t.ResponseHeaderTimeout = time.Second * 30
+	return t
+}
+
+// fillInBackground downloads the whole blob of a ranged cache miss into the
+// local cache, unless it is cached or being downloaded already.
+func (h *hfProxy) fillInBackground(req *http.Request, etag string) {
+	if !h.rangeFill {
+		return
+	}
+	h.fill(etag, h.upstreamFetch(req, etag))
+}
+
+// upstreamFetch returns a fetch of the blob of req from upstream for fill, hub
+// urls are fetched with the token the proxy would send upstream for req.
+func (h *hfProxy) upstreamFetch(req *http.Request, etag string) func(ctx context.Context) error {
+	blobUrl := req.URL.String()
+	auth := h.upstreamAuth(req)
+	return func(ctx context.Context) error {
+		_, err := h.fetchBlob(ctx, blobUrl, auth, etag)
+		return err
+	}
+}
+
+// upstreamAuth is the Authorization header the proxy sends upstream for req,
+// hub urls carry the client's token or the configured service token.
+func (h *hfProxy) upstreamAuth(req *http.Request) string {
+	if f := h.hub.getFileInfo(req.URL); f != nil {
+		return bearer(h.auth.token(req, f))
+	}
+	return req.Header.Get("Authorization")
+}
+
+// remoteFetch returns a fetch of the blob at filePath of the remote cache for fill.
+func (h *hfProxy) remoteFetch(filePath, etag string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := h.fetchRemoteBlob(ctx, filePath, etag)
+		return err
+	}
+}
+
+// fillFromRemote downloads a blob of the remote cache into the local cache in the background.
+func (h *hfProxy) fillFromRemote(etag, filePath string) {
+	h.fill(etag, h.remoteFetch(filePath, etag))
+}
+
+// fill runs fetch in the background as the leader of the flight of etag. It
+// returns the flight, leader is true when fetch was started by this call, the
+// flight is nil when the blob is cached or being downloaded already.
+func (h *hfProxy) fill(etag string, fetch func(ctx context.Context) error) (f *flight, leader bool) {
+	if h.offline || h.fileCache.HasFile(etag) {
+		return nil, false
+	}
+	if rd, _, ok := h.fileCache.OpenDownloading(etag); ok {
+		rd.Close()
+		return nil, false
+	}
+	if f, leader = h.flights.join(etag); !leader {
+		return f, false
+	}
+	started := h.goBackground(func(ctx context.Context) {
+		defer h.flights.release(etag)
+		if err := fetch(ctx); err != nil {
+			log.WithFields(log.Fields{"etag": etag}).Errorf("background blob fill failed, err:%v", err)
+		}
+	})
+	if !started {
+		h.flights.release(etag)
+	}
+	return f, started
+}
+
+// goBackground runs fn in a goroutine that Shutdown waits for, false is
+// returned without running fn once the shutdown began.
+func (h *hfProxy) goBackground(fn func(ctx context.Context)) bool {
+	h.backgroundMux.Lock()
+	defer h.backgroundMux.Unlock()
+	if h.stopping {
+		return false
+	}
+	h.background.Add(1)
+	h.running++
+	go func() {
+		defer h.background.Done()
+		defer func() {
+			h.backgroundMux.Lock()
+			h.running--
+			h.backgroundMux.Unlock()
+		}()
+		fn(h.ctx)
+	}()
+	return true
+}
+
+// Shutdown waits for the background fills, revalidations and prefetch jobs of h, which must
+// be created by NewHFProxy, until ctx is done and aborts the ones left then.
+// Aborted downloads discard their incomplete blobs.
+func Shutdown(ctx context.Context, h http.Handler) error {
+	proxy, ok := h.(*hfProxy)
+	if !ok {
+		return fmt.Errorf("shutdown needs a hf proxy handler, got %T", h)
+	}
+	proxy.backgroundMux.Lock()
+	proxy.stopping = true
+	proxy.backgroundMux.Unlock()
+	if proxy.runningCount() == 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		proxy.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	aborted := proxy.runningCount()
+	if aborted == 0 {
+		return nil
+	}
+	proxy.abort()
+	// aborted downloads return at their next read, give them a moment to clean up
+	select {
+	case <-done:
+	case <-time.After(abortGrace):
+	}
+	return fmt.Errorf("aborted %d background jobs, %v", aborted, ctx.Err())
+}
+
+func (h *hfProxy) runningCount() int {
+	h.backgroundMux.Lock()
+	defer h.backgroundMux.Unlock()
+	return h.running
+}
+
+// fetchBlob downloads url, following redirects, into the local blob of etag,
+// n is the number of bytes written.
+func (h *hfProxy) fetchBlob(ctx context.Context, url, auth, etag string) (n int64, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if auth != "" {
+		// dropped by the client on redirects to other hosts like the lfs cdn
+		req.Header.Set("Authorization", auth)
+	}
+	res, err := h.fillClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.ContentLength <= 0 {
+		return 0, fmt.Errorf("unexpected response, status:%v, length:%v", res.StatusCode, res.ContentLength)
+	}
+	fd, err := h.createBlobWriter(etag, res.ContentLength, res.Request.URL.Host)
+	if err != nil {
+		return 0, err
+	}
+	// followers may tail the tmp file from now on
+	h.flights.release(etag)
+	log.WithFields(log.Fields{"etag": etag}).Infof("background blob fill started")
+	n, err = io.Copy(fd, res.Body)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// fetchRemoteBlob downloads a blob of the remote cache into the local cache,
+// it is not uploaded again once complete. n is the number of bytes written.
+func (h *hfProxy) fetchRemoteBlob(ctx context.Context, filePath, etag string) (n int64, err error) {
+	obj, err := h.remoteCache.Download(ctx, filePath, "")
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Body.Close()
+	fd, err := h.fileCache.CreateBlobWriter(etag, obj.ContentLength, nil)
+	if err != nil {
+		return 0, err
+	}
+	h.flights.release(etag)
+	log.WithFields(log.Fields{"etag": etag}).Infof("background blob fill from remote oss storage started")
+	n, err = io.Copy(fd, obj.Body)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
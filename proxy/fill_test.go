@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestUpstreamFetchUsesServiceToken(t *testing.T) {
+	var got string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header.Get("Authorization")
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+	hub, err := newHubUrls(upstream.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &hfProxy{
+		hub:        hub,
+		auth:       newAuthorizer([]*Credential{{Pattern: "org/*", Token: "service"}}, NewHGClient(hub), false),
+		fillClient: &http.Client{Transport: newFillTransport()},
+	}
+	cases := []struct {
+		clientAuth string
+		want       string
+	}{
+		{"", "Bearer service"},
+		{"Bearer client", "Bearer client"},
+	}
+	for _, c := range cases {
+		blobUrl, _ := url.Parse(upstream.URL + "/org/gated/resolve/main/model.bin")
+		req := &http.Request{Method: http.MethodGet, URL: blobUrl, Header: http.Header{}}
+		if c.clientAuth != "" {
+			req.Header.Set("Authorization", c.clientAuth)
+		}
+		if err := h.upstreamFetch(req, "etag")(context.Background()); err == nil {
+			t.Fatal("fetch of a missing blob succeeded")
+		}
+		if got != c.want {
+			t.Errorf("client auth %q: upstream got %q, want %q", c.clientAuth, got, c.want)
+		}
+	}
+}
+
+func TestUpstreamRangeUsesServiceToken(t *testing.T) {
+	var got string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header.Get("Authorization")
+		if got == "" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.Header().Set("Content-Range", "bytes 4-7/10")
+		rw.WriteHeader(http.StatusPartialContent)
+		rw.Write([]byte("4567"))
+	}))
+	defer upstream.Close()
+	hub, err := newHubUrls(upstream.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &hfProxy{
+		hub:        hub,
+		auth:       newAuthorizer([]*Credential{{Pattern: "org/*", Token: "service"}}, NewHGClient(hub), false),
+		fillClient: &http.Client{Transport: newFillTransport()},
+	}
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/org/gated/resolve/main/model.bin", nil)
+	req.Header.Set("Range", "bytes=0-7")
+	if err := h.copyUpstreamRange(io.Discard, req, 4, 7); err != nil {
+		t.Fatal(err)
+	}
+	if got != "Bearer service" {
+		t.Errorf("upstream got %q, want the service token", got)
+	}
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hf-mirror/health"
+	"net/http"
+)
+
+// NewUpstreamCheck returns a health check of the hub of h, which must be created by NewHFProxy.
+func NewUpstreamCheck(h http.Handler) (health.CheckFunc, error) {
+	proxy, ok := h.(*hfProxy)
+	if !ok {
+		return nil, fmt.Errorf("upstream check needs a hf proxy handler, got %T", h)
+	}
+	return func(ctx context.Context) (any, error) {
+		if proxy.offline {
+			return "offline", nil
+		}
+		return proxy.hub.endpoint, proxy.hgClient.Ping(ctx)
+	}, nil
+}
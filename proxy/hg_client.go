@@ -1,35 +1,115 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"hf-mirror/metacache"
+	"hf-mirror/metrics"
+	"hf-mirror/tracing"
 	"net/http"
+	"net/url"
 	"time"
 )
 
 type HGClient struct {
 	cli *http.Client
+	hub *hubUrls
 }
 
-func NewHGClient() *HGClient {
+func NewHGClient(hub *hubUrls) *HGClient {
 	return &HGClient{
+		hub: hub,
 		cli: &http.Client{
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return http.ErrUseLastResponse
 			},
-			Timeout: time.Second * 5,
+			Timeout:   time.Second * 5,
+			Transport: tracing.Transport("hg_client", metrics.InstrumentTransport("hg_client", nil)),
 		},
 	}
 }
 
-func (h *HGClient) FileMeta(prj, file, rev string) metacache.FileMetadata {
-	url := fmt.Sprintf("https://huggingface.co/%s/resolve/%s/%s", prj, rev, file)
-	res, err := h.cli.Head(url)
+func (h *HGClient) headFile(ctx context.Context, f *HfFile, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.hub.fileUrl(f), nil)
 	if err != nil {
-		log.Errorf("head file meta failed, url:%v, err:%v", url, err)
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return h.cli.Do(req)
+}
+
+func (h *HGClient) FileMeta(ctx context.Context, f *HfFile, token string) (meta metacache.FileMetadata) {
+	ctx, span := tracing.Start(ctx, "HGClient.FileMeta", f.Attributes()...)
+	var err error
+	defer func() {
+		span.SetAttributes(attribute.String("hf.etag", meta.Etag))
+		tracing.End(span, err)
+	}()
+	res, err := h.headFile(ctx, f, token)
+	if err != nil {
+		log.WithFields(f.LogFields()).Errorf("head file meta failed, err:%v", err)
 		return metacache.FileMetadata{}
 	}
 	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		err = fmt.Errorf("head file meta failed, status:%v", res.StatusCode)
+		log.WithFields(f.LogFields()).Error(err)
+		return metacache.FileMetadata{}
+	}
 	return HfFileMetadata(res)
 }
+
+// Ping checks that the hub answers, any response but a server error counts.
+func (h *HGClient) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.hub.endpoint+"/", nil)
+	if err != nil {
+		return err
+	}
+	res, err := h.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("hub %v answered status:%v", h.hub.endpoint, res.StatusCode)
+	}
+	return nil
+}
+
+// Authorized reports whether token is allowed to read f, an empty token checks anonymous access.
+func (h *HGClient) Authorized(f *HfFile, token string) (bool, error) {
+	return h.CanRead(h.hub.fileUrl(f), token)
+}
+
+// CanRead reports whether a HEAD of url with token succeeds.
+func (h *HGClient) CanRead(url, token string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := h.cli.Do(req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	return res.StatusCode < http.StatusBadRequest, nil
+}
+
+// RepoInfo fetches the revision api of the repo of a, the caller closes the body.
+func (h *HGClient) RepoInfo(a *HfApiRequest, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, h.hub.apiUrl(a)+"/revision/"+url.PathEscape(a.Revision), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return h.cli.Do(req)
+}
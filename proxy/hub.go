@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"fmt"
+	"hf-mirror/metacache"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultHubEndpoint = "https://huggingface.co"
+	defaultLfsEndpoint = "https://cdn-lfs.huggingface.co"
+)
+
+// hubUrls parses and builds urls of the configured upstream hub and its lfs hosts,
+// so that the mirror can be chained behind another mirror or a fake hub.
+type hubUrls struct {
+	endpoint string
+	host     string
+	basePath string
+	lfsReg   *regexp.Regexp
+	hosts    map[string]bool
+}
+
+func newHubUrls(hubEndpoint string, lfsEndpoints []string) (*hubUrls, error) {
+	hubUrl, err := url.Parse(strings.TrimSuffix(hubEndpoint, "/"))
+	if err != nil || hubUrl.Host == "" {
+		return nil, fmt.Errorf("invalid hub endpoint %q, err:%v", hubEndpoint, err)
+	}
+	hosts := map[string]bool{hubUrl.Host: true}
+	var lfsHosts []string
+	for _, ep := range lfsEndpoints {
+		lfsUrl, err := url.Parse(ep)
+		if err != nil || lfsUrl.Host == "" {
+			return nil, fmt.Errorf("invalid lfs endpoint %q, err:%v", ep, err)
+		}
+		hosts[lfsUrl.Host] = true
+		lfsHosts = append(lfsHosts, regexp.QuoteMeta(lfsUrl.Host))
+	}
+	u := &hubUrls{
+		endpoint: hubUrl.String(),
+		host:     hubUrl.Host,
+		basePath: hubUrl.EscapedPath(),
+		hosts:    hosts,
+	}
+	if len(lfsHosts) > 0 {
+		u.lfsReg = regexp.MustCompile("(?:" + strings.Join(lfsHosts, "|") + ")/(.*)/([0-9a-zA-Z]+)?.*")
+	}
+	return u, nil
+}
+
+// isUpstream reports whether host is the hub or one of its lfs hosts.
+func (u *hubUrls) isUpstream(host string) bool {
+	return u.hosts[host]
+}
+
+// proxyRedirect routes the location of an upstream redirect through the mirror,
+// it is resolved against reqUrl as chained mirrors may answer with relative ones.
+// ok is false for other responses and locations off the hub and its lfs hosts.
+func (u *hubUrls) proxyRedirect(proxyUrl string, code int, reqUrl *url.URL, location string) (string, bool) {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return "", false
+	}
+	if location == "" {
+		return "", false
+	}
+	locUrl, err := reqUrl.Parse(location)
+	if err != nil || !u.isUpstream(locUrl.Host) {
+		return "", false
+	}
+	return proxyUrl + locUrl.String(), true
+}
+
+func escapePath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+func (u *hubUrls) fileUrl(f *HfFile) string {
+	return fmt.Sprintf("%s/%s/resolve/%s/%s", u.endpoint, escapePath(f.RepoUrlPath()), url.PathEscape(f.Revision), escapePath(f.Path))
+}
+
+// repoPath returns the escaped path of uri below the hub endpoint, ok is false for other hosts.
+func (u *hubUrls) repoPath(uri *url.URL) (string, bool) {
+	if uri.Host != u.host || !strings.HasPrefix(uri.EscapedPath(), u.basePath+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(uri.EscapedPath(), u.basePath), true
+}
+
+// getFileInfo parses a hub resolve url, nil is returned for any other url.
+func (u *hubUrls) getFileInfo(uri *url.URL) *HfFile {
+	p, ok := u.repoPath(uri)
+	if !ok {
+		return nil
+	}
+	return parseHfFile(p)
+}
+
+// getApiInfo parses a cacheable hub api url, nil is returned for any other url.
+func (u *hubUrls) getApiInfo(uri *url.URL) *HfApiRequest {
+	p, ok := u.repoPath(uri)
+	if !ok {
+		return nil
+	}
+	return parseHfApiRequest(p, uri.RawQuery)
+}
+
+// apiUrl is the repo info url of a, used to probe access to the repo.
+func (u *hubUrls) apiUrl(a *HfApiRequest) string {
+	return fmt.Sprintf("%s/api/%ss/%s", u.endpoint, a.Type, escapePath(a.Repo))
+}
+
+func (u *hubUrls) getLfsEtag(uri *url.URL) string {
+	if u.lfsReg == nil {
+		return ""
+	}
+	matches := u.lfsReg.FindAllStringSubmatch(uri.String(), -1)
+	if len(matches) > 0 && len(matches[0]) == 3 {
+		return matches[0][2]
+	}
+	return ""
+}
+
+// modifyFileLocation pins a hub resolve location to the resolved commit and
+// points it at the mirror, lfs locations are only routed through the mirror.
+func (u *hubUrls) modifyFileLocation(proxyUrl string, meta metacache.FileMetadata) string {
+	if meta.Etag == "" || meta.Location == "" {
+		return ""
+	}
+	replacedLocation := meta.Location
+	if locUrl, err := url.Parse(meta.Location); err == nil && meta.CommitHash != "" {
+		if f := u.getFileInfo(locUrl); f != nil {
+			f.Revision = meta.CommitHash
+			replacedLocation = u.fileUrl(f)
+			if locUrl.RawQuery != "" {
+				replacedLocation += "?" + locUrl.RawQuery
+			}
+		}
+	}
+	proxyLocation := proxyUrl + replacedLocation
+	locUrl, _ := url.Parse(proxyLocation)
+	if locUrl != nil {
+		vals := locUrl.Query()
+		vals.Set(INJECT_ETAG, meta.Etag)
+		locUrl.RawQuery = vals.Encode()
+		proxyLocation = locUrl.String()
+	}
+	return proxyLocation
+}
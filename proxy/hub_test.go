@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProxyRedirect(t *testing.T) {
+	hub, err := newHubUrls("https://mirror.internal/hf", []string{"https://lfs.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqUrl, _ := url.Parse("https://mirror.internal/hf/org/model/resolve/main/config.json")
+	cases := []struct {
+		code     int
+		location string
+		want     string
+	}{
+		{http.StatusFound, "https://lfs.internal/repos/abc", "http://proxy/https://lfs.internal/repos/abc"},
+		{http.StatusTemporaryRedirect, "/hf/org/model/resolve/c1/config.json", "http://proxy/https://mirror.internal/hf/org/model/resolve/c1/config.json"},
+		{http.StatusPermanentRedirect, "c1.json", "http://proxy/https://mirror.internal/hf/org/model/resolve/main/c1.json"},
+		{http.StatusMovedPermanently, "https://mirror.internal/hf/org/other", "http://proxy/https://mirror.internal/hf/org/other"},
+		// off the configured hosts the client follows the redirect itself
+		{http.StatusFound, "https://elsewhere.example/blob", ""},
+		{http.StatusOK, "https://lfs.internal/repos/abc", ""},
+		{http.StatusFound, "", ""},
+	}
+	for _, c := range cases {
+		got, ok := hub.proxyRedirect("http://proxy/", c.code, reqUrl, c.location)
+		if ok != (c.want != "") || got != c.want {
+			t.Errorf("%v %q: got %q, %v, want %q", c.code, c.location, got, ok, c.want)
+		}
+	}
+}
+
+func TestUpstreamRedirectThroughProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/moved":
+			http.Redirect(rw, req, "/target", http.StatusTemporaryRedirect)
+		case "/away":
+			http.Redirect(rw, req, "https://elsewhere.example/target", http.StatusPermanentRedirect)
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer upstream.Close()
+	env := newAdminTestEnv(t, upstream.URL)
+	h := env.proxy
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/moved", h.proxyUrl + upstream.URL + "/target"},
+		{"/away", "https://elsewhere.example/target"},
+	}
+	for _, c := range cases {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/"+upstream.URL+c.path, nil))
+		if got := rw.Header().Get("Location"); got != c.want {
+			t.Errorf("%v: status %v, location %q, want %q", c.path, rw.Code, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// serveOffline answers HEAD, GET and hub api requests from the meta cache and the
+// local blob cache only, anything that is not cached gets a huggingface style 404.
+func (h *hfProxy) serveOffline(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodHead:
+		if h.ServeLocalFileMeta(rw, req) {
+			return
+		}
+	case http.MethodGet:
+		if a := h.hub.getApiInfo(req.URL); a != nil {
+			if h.serveCachedApi(rw, req, a) {
+				return
+			}
+			break
+		}
+		etag := h.getEtagFromUri(req)
+		if etag == "" {
+			if f := h.hub.getFileInfo(req.URL); f != nil {
+				annotateFile(req, f)
+				if meta := h.metaCache.SearchMetaData(f.RepoKey(), f.Path, f.Revision); meta != nil {
+					etag = meta.Etag
+				}
+			} else {
+				etag = h.hub.getLfsEtag(req.URL)
+			}
+		}
+		if etag != "" {
+			annotateEtag(req, etag)
+			switch h.checkBlobAccess(rw, req, etag) {
+			case blobDenied:
+				return
+			case blobUnknown:
+				// nobody can tell whether the blob is gated while offline
+				log.WithFields(log.Fields{"etag": etag}).Warnf("offline mode, blob owner unknown")
+				writeHfError(rw, http.StatusForbidden, HUGGINGFACE_ERROR_GATED_REPO, "Access to blob "+etag+" cannot be verified in offline mirror.")
+				return
+			}
+		}
+		if etag != "" && h.serveLocalFile(rw, req, etag) {
+			return
+		}
+	}
+	log.WithFields(log.Fields{"url": req.URL.String()}).Infof("offline mode, entry not cached")
+	writeHfError(rw, http.StatusNotFound, HUGGINGFACE_ERROR_ENTRY_NOT_FOUND, "Entry not found in offline mirror cache.")
+}
+
+func writeHfError(rw http.ResponseWriter, code int, errCode, msg string) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set(HUGGINGFACE_HEADER_X_ERROR_CODE, errCode)
+	rw.Header().Set(HUGGINGFACE_HEADER_X_ERROR_MSG, msg)
+	rw.WriteHeader(code)
+	rw.Write([]byte(msg))
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hf-mirror/fs"
+	"hf-mirror/metrics"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// servePartial answers a Range request from the already downloaded part of a
+// blob that is still being downloaded, only the missing remainder of the range
+// is fetched upstream. It returns false when no requested byte is local yet.
+func (h *hfProxy) servePartial(rw http.ResponseWriter, req *http.Request, etag string) bool {
+	blob, ok := h.fileCache.OpenPartial(etag)
+	if !ok {
+		return false
+	}
+	defer blob.Close()
+	size := blob.Size()
+	rng, ok := fs.ParseRange(req.Header.Get("Range"), size)
+	if !ok {
+		return false
+	}
+	start, end := rng.Start, rng.End-1
+	local, ok := blob.Covering(start)
+	if !ok {
+		return false
+	}
+	localEnd := end + 1
+	if local.End < localEnd {
+		localEnd = local.End
+	}
+	log.WithFields(log.Fields{"etag": etag, "range": req.Header.Get("Range")}).
+		Infof("range served from partial download, local bytes:%v", localEnd-start)
+	rw = serveBlob(rw, req, metrics.TierLocal)
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	rw.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	rw.Header().Set("ETag", fmt.Sprintf("\"%s\"", etag))
+	rw.Header().Set("Accept-Ranges", "bytes")
+	rw.WriteHeader(http.StatusPartialContent)
+	if _, err := io.Copy(rw, io.NewSectionReader(blob, start, localEnd-start)); err != nil {
+		return true
+	}
+	if localEnd > end {
+		return true
+	}
+	if err := h.copyUpstreamRange(rw, req, localEnd, end); err != nil {
+		log.WithFields(log.Fields{"etag": etag}).Errorf("fetch remainder of range failed, err:%v", err)
+		// the status line is sent already, abort so the client sees a truncated body
+		panic(http.ErrAbortHandler)
+	}
+	return true
+}
+
+// copyUpstreamRange copies the inclusive byte range start-end of the requested
+// blob from upstream to w, authorised like a full download of it.
+func (h *hfProxy) copyUpstreamRange(w io.Writer, req *http.Request, start, end int64) error {
+	upReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, req.URL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if auth := h.upstreamAuth(req); auth != "" {
+		upReq.Header.Set("Authorization", auth)
+	}
+	upReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	res, err := h.fillClient.Do(upReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unexpected status %v", res.StatusCode)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", start)) {
+		return fmt.Errorf("unexpected content range %q", res.Header.Get("Content-Range"))
+	}
+	n, err := io.Copy(w, res.Body)
+	if err == nil && n != end-start+1 {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,485 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PrefetchPending  = "pending"
+	PrefetchRunning  = "running"
+	PrefetchDone     = "done"
+	PrefetchFailed   = "failed"
+	PrefetchCanceled = "canceled"
+
+	// maxPrefetchJobs bounds the finished jobs kept for status queries.
+	maxPrefetchJobs = 100
+	// maxPrefetchErrors bounds the file errors recorded per job.
+	maxPrefetchErrors = 20
+)
+
+var errShuttingDown = errors.New("the mirror is shutting down")
+
+// PrefetchRequest asks for a repo snapshot to be downloaded into the caches.
+type PrefetchRequest struct {
+	// RepoType is one of "model", "dataset" or "space", models are the default.
+	RepoType string `json:"repo_type,omitempty"`
+	Repo     string `json:"repo"`
+	// Revision defaults to "main".
+	Revision string `json:"revision,omitempty"`
+	// AllowPatterns and IgnorePatterns filter the files like huggingface_hub's
+	// snapshot_download, "*" matches across "/" and "dir/" matches all files below dir.
+	AllowPatterns  []string `json:"allow_patterns,omitempty"`
+	IgnorePatterns []string `json:"ignore_patterns,omitempty"`
+	// Token is used upstream instead of a configured service token, it is not reported back.
+	Token string `json:"token,omitempty"`
+}
+
+// PrefetchJob is the progress of a PrefetchRequest.
+type PrefetchJob struct {
+	ID         string           `json:"id"`
+	Request    *PrefetchRequest `json:"request"`
+	Status     string           `json:"status"`
+	CommitHash string           `json:"commit_hash,omitempty"`
+	// Files is the number of files selected, Done those in the cache now, of
+	// which Cached were already there, and Failed those that could not be fetched.
+	Files  int      `json:"files"`
+	Done   int      `json:"done"`
+	Cached int      `json:"cached"`
+	Failed int      `json:"failed"`
+	Bytes  int64    `json:"bytes"`
+	Error  string   `json:"error,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// prefetcher runs prefetch jobs, the files of a job are fetched concurrent at a time.
+type prefetcher struct {
+	proxy      *hfProxy
+	concurrent int
+
+	mux  sync.Mutex
+	jobs map[string]*PrefetchJob
+}
+
+func newPrefetcher(proxy *hfProxy, concurrent int) *prefetcher {
+	if concurrent <= 0 {
+		concurrent = 1
+	}
+	return &prefetcher{
+		proxy:      proxy,
+		concurrent: concurrent,
+		jobs:       make(map[string]*PrefetchJob),
+	}
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validate fills in the defaults of req and returns the repo it addresses.
+func (req *PrefetchRequest) validate() (*HfFile, error) {
+	if req.RepoType == "" {
+		req.RepoType = string(RepoTypeModel)
+	}
+	repoType := RepoType(req.RepoType)
+	if _, ok := repoTypePrefixes[req.RepoType+"s"]; !ok {
+		return nil, fmt.Errorf("invalid repo type %q", req.RepoType)
+	}
+	if req.Repo == "" || strings.Count(req.Repo, "/") > 1 {
+		return nil, fmt.Errorf("invalid repo %q", req.Repo)
+	}
+	if req.Revision == "" {
+		req.Revision = "main"
+	}
+	for _, p := range append(append([]string{}, req.AllowPatterns...), req.IgnorePatterns...) {
+		if _, err := globRegexp(p); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q, %v", p, err)
+		}
+	}
+	return &HfFile{Type: repoType, Repo: req.Repo, Revision: req.Revision}, nil
+}
+
+func (p *prefetcher) start(req *PrefetchRequest) (*PrefetchJob, error) {
+	repo, err := req.validate()
+	if err != nil {
+		return nil, err
+	}
+	token := req.Token
+	if token == "" {
+		token = p.proxy.auth.serviceToken(repo)
+	}
+	reported := *req
+	reported.Token = ""
+	ctx, cancel := context.WithCancel(p.proxy.ctx)
+	job := &PrefetchJob{
+		ID:        newJobId(),
+		Request:   &reported,
+		Status:    PrefetchPending,
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+	}
+	p.mux.Lock()
+	p.jobs[job.ID] = job
+	p.pruneLocked()
+	snapshot := *job
+	p.mux.Unlock()
+
+	started := p.proxy.goBackground(func(context.Context) {
+		defer cancel()
+		p.run(ctx, job, repo, token)
+	})
+	if !started {
+		cancel()
+		p.mux.Lock()
+		delete(p.jobs, job.ID)
+		p.mux.Unlock()
+		return nil, errShuttingDown
+	}
+	return &snapshot, nil
+}
+
+// pruneLocked drops the oldest finished jobs beyond maxPrefetchJobs.
+func (p *prefetcher) pruneLocked() {
+	if len(p.jobs) <= maxPrefetchJobs {
+		return
+	}
+	var finished []*PrefetchJob
+	for _, job := range p.jobs {
+		if job.FinishedAt != nil {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt.Before(*finished[j].FinishedAt) })
+	for i := 0; i < len(finished) && len(p.jobs) > maxPrefetchJobs; i++ {
+		delete(p.jobs, finished[i].ID)
+	}
+}
+
+func (p *prefetcher) get(id string) (PrefetchJob, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	job, ok := p.jobs[id]
+	if !ok {
+		return PrefetchJob{}, false
+	}
+	return *job, true
+}
+
+func (p *prefetcher) list() []PrefetchJob {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	jobs := make([]PrefetchJob, 0, len(p.jobs))
+	for _, job := range p.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs
+}
+
+func (p *prefetcher) cancel(id string) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	job, ok := p.jobs[id]
+	if ok {
+		job.cancel()
+	}
+	return ok
+}
+
+func (p *prefetcher) update(job *PrefetchJob, fn func(job *PrefetchJob)) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	fn(job)
+}
+
+func (p *prefetcher) finish(ctx context.Context, job *PrefetchJob, err error) {
+	p.update(job, func(job *PrefetchJob) {
+		now := time.Now()
+		job.FinishedAt = &now
+		switch {
+		case ctx.Err() != nil:
+			job.Status = PrefetchCanceled
+		case err != nil:
+			job.Status = PrefetchFailed
+			job.Error = err.Error()
+		case job.Failed > 0:
+			job.Status = PrefetchFailed
+			job.Error = fmt.Sprintf("%d of %d files failed", job.Failed, job.Files)
+		default:
+			job.Status = PrefetchDone
+		}
+	})
+	fields := log.Fields{"job": job.ID, "repo": job.Request.Repo, "revision": job.Request.Revision}
+	snapshot, _ := p.get(job.ID)
+	log.WithFields(fields).Infof("prefetch %v, files:%v, cached:%v, failed:%v, bytes:%v",
+		snapshot.Status, snapshot.Files, snapshot.Cached, snapshot.Failed, snapshot.Bytes)
+}
+
+func (p *prefetcher) run(ctx context.Context, job *PrefetchJob, repo *HfFile, token string) {
+	p.update(job, func(job *PrefetchJob) { job.Status = PrefetchRunning })
+	commitHash, files, err := p.proxy.repoFiles(repo, token)
+	if err == nil {
+		files, err = filterFiles(files, job.Request.AllowPatterns, job.Request.IgnorePatterns)
+	}
+	if err != nil {
+		p.finish(ctx, job, err)
+		return
+	}
+	p.update(job, func(job *PrefetchJob) {
+		job.CommitHash = commitHash
+		job.Files = len(files)
+	})
+	log.WithFields(repo.LogFields()).Infof("prefetch job %v started, %v files at %v", job.ID, len(files), commitHash)
+	// files are resolved at the listed commit, so a branch moving meanwhile does not mix revisions
+	revision := commitHash
+	if revision == "" {
+		revision = repo.Revision
+	}
+
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < p.concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				f := &HfFile{Type: repo.Type, Repo: repo.Repo, Revision: revision, Path: path}
+				n, cached, err := p.proxy.prefetchFile(ctx, f, token)
+				p.update(job, func(job *PrefetchJob) {
+					if err != nil {
+						job.Failed++
+						if len(job.Errors) < maxPrefetchErrors {
+							job.Errors = append(job.Errors, path+": "+err.Error())
+						}
+						return
+					}
+					job.Done++
+					job.Bytes += n
+					if cached {
+						job.Cached++
+					}
+				})
+				if err != nil && ctx.Err() == nil {
+					log.WithFields(f.LogFields()).Errorf("prefetch file failed, err:%v", err)
+				}
+			}
+		}()
+	}
+send:
+	for _, path := range files {
+		select {
+		case paths <- path:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(paths)
+	wg.Wait()
+	p.finish(ctx, job, nil)
+}
+
+type repoInfo struct {
+	Sha      string `json:"sha"`
+	Siblings []struct {
+		Rfilename string `json:"rfilename"`
+	} `json:"siblings"`
+}
+
+// repoFiles lists the files of the revision of repo via the hub api, the
+// response is stored in the meta cache so that the snapshot also resolves offline.
+func (h *hfProxy) repoFiles(repo *HfFile, token string) (string, []string, error) {
+	a := &HfApiRequest{Type: repo.Type, Repo: repo.Repo, Kind: apiKindRevision, Revision: repo.Revision}
+	res, err := h.hgClient.RepoInfo(a, token)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get repo info of %v, %v", repo.RepoKey(), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("failed to get repo info of %v, status:%v", repo.RepoKey(), res.StatusCode)
+	}
+	h.storeApiResponse(a, res)
+	var info repoInfo
+	if err = json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return "", nil, fmt.Errorf("failed to decode repo info of %v, %v", repo.RepoKey(), err)
+	}
+	// the response is stored once it was read to its end
+	io.Copy(io.Discard, res.Body)
+	files := make([]string, 0, len(info.Siblings))
+	for _, s := range info.Siblings {
+		files = append(files, s.Rfilename)
+	}
+	return info.Sha, files, nil
+}
+
+// globRegexp translates a fnmatch pattern as used by huggingface_hub, "*"
+// matches across "/" and a trailing "/" matches everything below a directory.
+// Like fnmatch.translate a "[" without a closing "]" is literal, "[!...]" is a
+// negated class and a "]" right after "[" or "[!" belongs to the class.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "*"
+	}
+	runes := []rune(pattern)
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			j := i + 1
+			if j < len(runes) && runes[j] == '!' {
+				j++
+			}
+			if j < len(runes) && runes[j] == ']' {
+				j++
+			}
+			for j < len(runes) && runes[j] != ']' {
+				j++
+			}
+			if j >= len(runes) {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := string(runes[i+1 : j])
+			negate := strings.HasPrefix(class, "!")
+			if negate {
+				class = class[1:]
+			}
+			class = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "^", `\^`).Replace(class)
+			if negate {
+				class = "^" + class
+			}
+			b.WriteString("[" + class + "]")
+			i = j
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func matchAny(patterns []*regexp.Regexp, file string) bool {
+	for _, p := range patterns {
+		if p.MatchString(file) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterFiles keeps the files matching one of allow, all when it is empty, and none of ignore.
+func filterFiles(files, allow, ignore []string) ([]string, error) {
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		var res []*regexp.Regexp
+		for _, p := range patterns {
+			reg, err := globRegexp(p)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, reg)
+		}
+		return res, nil
+	}
+	allowRegs, err := compile(allow)
+	if err != nil {
+		return nil, err
+	}
+	ignoreRegs, err := compile(ignore)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, file := range files {
+		if len(allowRegs) > 0 && !matchAny(allowRegs, file) {
+			continue
+		}
+		if matchAny(ignoreRegs, file) {
+			continue
+		}
+		res = append(res, file)
+	}
+	return res, nil
+}
+
+// prefetchFile resolves f and downloads its blob into the local cache, from the
+// remote cache when it has the blob, otherwise from upstream which also uploads
+// it to the remote cache. cached is true when the blob was in the local cache.
+func (h *hfProxy) prefetchFile(ctx context.Context, f *HfFile, token string) (n int64, cached bool, err error) {
+	meta := h.metaCache.SearchMetaData(f.RepoKey(), f.Path, f.Revision)
+	if meta == nil {
+		fresh := h.fetchFileMeta(ctx, f, token)
+		meta = &fresh
+	}
+	etag := meta.Etag
+	if etag == "" {
+		return 0, false, fmt.Errorf("failed to resolve file meta")
+	}
+	if h.fileCache.HasFile(etag) {
+		return 0, true, nil
+	}
+	flight, leader := h.flights.join(etag)
+	if !leader {
+		select {
+		case <-flight.ready:
+		case <-ctx.Done():
+			return 0, false, ctx.Err()
+		}
+		n, _, err = h.followDownload(etag)
+		return n, false, err
+	}
+	defer h.flights.release(etag)
+	// ranged and partial client downloads write the blob without a flight
+	if n, ok, err := h.followDownload(etag); ok || err == nil {
+		return n, false, err
+	}
+	filePath := h.fileCache.GetFilePath(etag)
+	if h.remoteCache.StatFile(ctx, filePath) == nil {
+		n, err = h.fetchRemoteBlob(ctx, filePath, etag)
+	} else {
+		n, err = h.fetchBlob(ctx, h.hub.fileUrl(f), bearer(token), etag)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return n, false, nil
+}
+
+// followDownload reads the download of etag another requester runs to its end
+// and checks that the blob completed, ok is false when none is running.
+func (h *hfProxy) followDownload(etag string) (n int64, ok bool, err error) {
+	rd, _, ok := h.fileCache.OpenDownloading(etag)
+	if ok {
+		n, err = io.Copy(io.Discard, rd)
+		rd.Close()
+		if err != nil {
+			return 0, true, err
+		}
+	}
+	if !h.fileCache.HasFile(etag) {
+		return 0, ok, fmt.Errorf("concurrent download of %v did not complete", etag)
+	}
+	return n, ok, nil
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"hf-mirror/metacache"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the expectations follow fnmatch.fnmatchcase, which huggingface_hub filters with
+func TestGlobRegexp(t *testing.T) {
+	cases := []struct {
+		pattern string
+		file    string
+		match   bool
+	}{
+		{"*.bin", "model.bin", true},
+		{"*.bin", "sub/model.bin", true},
+		{"*.bin", "model.bin.index.json", false},
+		{"sub/", "sub/model.bin", true},
+		{"sub/", "subdir/a", false},
+		{"model-?.bin", "model-1.bin", true},
+		{"model-?.bin", "model-10.bin", false},
+		{"[ab].txt", "a.txt", true},
+		{"[ab].txt", "c.txt", false},
+		{"[!ab].txt", "c.txt", true},
+		{"[!ab].txt", "a.txt", false},
+		{"[].txt", "].txt", false},
+		{"[].txt", "[].txt", true},
+		{"[]a].txt", "].txt", true},
+		{"[!]].txt", "a.txt", true},
+		{"[!]].txt", "].txt", false},
+		{"[.txt", "[.txt", true},
+		{"[.txt", "a.txt", false},
+		{"[^a].txt", "^.txt", true},
+		{"[^a].txt", "b.txt", false},
+		{`[\].txt`, `\.txt`, true},
+		{"[[].txt", "[.txt", true},
+		{"a+b(1).txt", "a+b(1).txt", true},
+		{"*.JSON", "config.json", false},
+		{"模型/*", "模型/a.bin", true},
+	}
+	for _, c := range cases {
+		reg, err := globRegexp(c.pattern)
+		if err != nil {
+			t.Errorf("%q: %v", c.pattern, err)
+			continue
+		}
+		if got := reg.MatchString(c.file); got != c.match {
+			t.Errorf("%q matching %q: got %v, want %v", c.pattern, c.file, got, c.match)
+		}
+	}
+}
+
+func TestFilterFiles(t *testing.T) {
+	files := []string{"config.json", "model.safetensors", "onnx/model.onnx", "pytorch_model.bin", "tokenizer.json"}
+	cases := []struct {
+		allow  []string
+		ignore []string
+		want   []string
+	}{
+		{nil, nil, files},
+		{[]string{"*.json"}, nil, []string{"config.json", "tokenizer.json"}},
+		{nil, []string{"*.bin", "onnx/"}, []string{"config.json", "model.safetensors", "tokenizer.json"}},
+		{[]string{"*.json", "*.safetensors"}, []string{"tokenizer*"}, []string{"config.json", "model.safetensors"}},
+		{[]string{"*.gguf"}, nil, nil},
+	}
+	for _, c := range cases {
+		got, err := filterFiles(files, c.allow, c.ignore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("allow %q ignore %q: got %q, want %q", c.allow, c.ignore, got, c.want)
+		}
+	}
+}
+
+func TestPrefetchFileFollowsRunningDownload(t *testing.T) {
+	blob := []byte("weights of the model")
+	var gets atomic.Int32
+	hub := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		gets.Add(1)
+		rw.Write(blob)
+	}))
+	defer hub.Close()
+	env := newAdminTestEnv(t, hub.URL)
+	h := env.proxy
+	// the metadata size is not what is reported as fetched
+	running := &HfFile{Type: RepoTypeModel, Repo: "org/model", Revision: "main", Path: "running.bin"}
+	h.storeFileMeta(running, &metacache.FileMetadata{Tag: "main", CommitHash: "c1", Etag: "running", Size: "999"})
+	fresh := &HfFile{Type: RepoTypeModel, Repo: "org/model", Revision: "main", Path: "fresh.bin"}
+	h.storeFileMeta(fresh, &metacache.FileMetadata{Tag: "main", CommitHash: "c1", Etag: "fresh", Size: "999"})
+
+	// a client download holds the blob without a flight
+	finish := env.writeBlob(t, "running", blob, false)
+	type result struct {
+		n   int64
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		n, _, err := h.prefetchFile(context.Background(), running, "")
+		done <- result{n, err}
+	}()
+	time.Sleep(time.Millisecond * 50)
+	finish()
+	res := <-done
+	if res.err != nil || res.n != int64(len(blob)) {
+		t.Errorf("prefetch of a running download: %v bytes, %v", res.n, res.err)
+	}
+	if gets.Load() != 0 {
+		t.Errorf("running download fetched upstream %v times", gets.Load())
+	}
+
+	n, cached, err := h.prefetchFile(context.Background(), fresh, "")
+	if err != nil || cached || n != int64(len(blob)) {
+		t.Errorf("prefetch from upstream: %v bytes, cached %v, %v", n, cached, err)
+	}
+}
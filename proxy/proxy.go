@@ -1,42 +1,84 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"hf-mirror/accesslog"
 	"hf-mirror/fs"
 	"hf-mirror/metacache"
+	"hf-mirror/metrics"
 	"hf-mirror/oss"
+	"hf-mirror/tracing"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	HUGGINGFACE_HEADER_X_REPO_COMMIT = "X-Repo-Commit"
 	HUGGINGFACE_HEADER_X_LINKED_ETAG = "X-Linked-Etag"
 	HUGGINGFACE_HEADER_X_LINKED_SIZE = "X-Linked-Size"
+	HUGGINGFACE_HEADER_X_ERROR_CODE  = "X-Error-Code"
+	HUGGINGFACE_HEADER_X_ERROR_MSG   = "X-Error-Message"
 
-	INJECT_ETAG = "x-etag"
-)
+	HUGGINGFACE_ERROR_ENTRY_NOT_FOUND = "EntryNotFound"
 
-var (
-	HuggingfaceUrlReg    = regexp.MustCompile("huggingface.co/(.*)/resolve/(.*)")
-	LfsHuggingfaceUrlReg = regexp.MustCompile("cdn-lfs.huggingface.co/(.*)/([0-9a-zA-Z]+)?.*")
+	INJECT_ETAG = "x-etag"
 )
 
 type ProxyConfig struct {
 	Addr     string   `yaml:"addr"`
 	ProxyUrl string   `yaml:"proxy_url"`
 	Targets  []string `yaml:"targets"`
+	// HubEndpoint is the upstream hub files are resolved against, it may be another mirror.
+	HubEndpoint string `yaml:"hub_endpoint"`
+	// LfsEndpoints are the hosts the hub redirects lfs downloads to.
+	LfsEndpoints []string `yaml:"lfs_endpoints"`
+	// Offline serves requests purely from the meta cache and local blobs, upstream is never dialed.
+	Offline bool `yaml:"offline"`
+	// RevalidateAfter is how long metadata of a mutable revision like "main" is served
+	// before it is refreshed from upstream in the background, commit hashes never expire.
+	RevalidateAfter time.Duration `yaml:"revalidate_after"`
+	// Credentials are service tokens injected upstream for matching repos, see Credential.
+	Credentials []*Credential `yaml:"credentials"`
+	// CoalesceWait is how long concurrent misses of a blob wait for the first
+	// requester's download to start before fetching it upstream themselves.
+	CoalesceWait time.Duration `yaml:"coalesce_wait"`
+	// RangeFill fetches the whole blob into the local cache in the background
+	// when a Range request misses, while the range itself is proxied as usual.
+	RangeFill bool `yaml:"range_fill"`
+	// OssRedirect answers downloads of blobs found in the remote cache with a
+	// redirect to a presigned bucket url instead of proxying the bytes.
+	OssRedirect bool `yaml:"oss_redirect"`
+	// OssRedirectExpire is how long the presigned urls stay valid.
+	OssRedirectExpire time.Duration `yaml:"oss_redirect_expire"`
+	// ShutdownTimeout is how long in-flight downloads, background fills and
+	// prefetch jobs may take to finish after SIGTERM before they are aborted.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
 }
 
 func NewConfig() *ProxyConfig {
 	return &ProxyConfig{
-		Addr:     "0.0.0.0:8082",
-		ProxyUrl: "http://127.0.0.1:8082/",
-		Targets:  []string{},
+		Addr:            "0.0.0.0:8082",
+		ProxyUrl:        "http://127.0.0.1:8082/",
+		Targets:         []string{},
+		HubEndpoint:     defaultHubEndpoint,
+		LfsEndpoints:    []string{defaultLfsEndpoint},
+		Offline:         false,
+		RevalidateAfter: time.Minute * 10,
+		Credentials:     []*Credential{},
+		CoalesceWait:    time.Second * 30,
+		RangeFill:       true,
+
+		OssRedirect:       false,
+		OssRedirectExpire: time.Minute * 15,
+		ShutdownTimeout:   time.Second * 30,
 	}
 }
 
@@ -48,11 +90,38 @@ type hfProxy struct {
 	fileCache    fs.FileLocalCache
 	remoteCache  oss.RemoteCache
 	hgClient     *HGClient
+	hub          *hubUrls
+	auth         *authorizer
+	offline      bool
+
+	revalidateAfter time.Duration
+	revalidating    sync.Map
+	coalesceWait    time.Duration
+	flights         *flightGroup
+	rangeFill       bool
+	fillClient      *http.Client
+
+	// background tracks fills and prefetch jobs, ctx is canceled when they are aborted on shutdown.
+	background    sync.WaitGroup
+	backgroundMux sync.Mutex
+	running       int
+	stopping      bool
+	ctx           context.Context
+	abort         context.CancelFunc
+
+	ossRedirect       bool
+	ossRedirectExpire time.Duration
 }
 
 func NewHFProxy(cfg *ProxyConfig, metaCache metacache.MetaDataCache, localCache fs.FileLocalCache, remoteCache oss.RemoteCache) http.Handler {
 	proxies := make(map[string]*httputil.ReverseProxy)
-	targets := cfg.Targets
+	hub, err := newHubUrls(cfg.HubEndpoint, cfg.LfsEndpoints)
+	if err != nil {
+		panic(err)
+	}
+	targets := withUpstreamTargets(cfg.Targets, append([]string{cfg.HubEndpoint}, cfg.LfsEndpoints...))
+	hgClient := NewHGClient(hub)
+	ctx, abort := context.WithCancel(context.Background())
 	handler := &hfProxy{
 		proxyUrl:     cfg.ProxyUrl,
 		targets:      targets,
@@ -60,49 +129,72 @@ func NewHFProxy(cfg *ProxyConfig, metaCache metacache.MetaDataCache, localCache
 		metaCache:    metaCache,
 		fileCache:    localCache,
 		remoteCache:  remoteCache,
-		hgClient:     NewHGClient(),
+		hgClient:     hgClient,
+		hub:          hub,
+		auth:         newAuthorizer(cfg.Credentials, hgClient, cfg.Offline),
+		offline:      cfg.Offline,
+
+		revalidateAfter: cfg.RevalidateAfter,
+		coalesceWait:    cfg.CoalesceWait,
+		flights:         newFlightGroup(),
+		rangeFill:       cfg.RangeFill,
+		fillClient:      &http.Client{Transport: tracing.Transport("fill", metrics.InstrumentTransport("fill", newFillTransport()))},
+
+		ossRedirect:       cfg.OssRedirect,
+		ossRedirectExpire: cfg.OssRedirectExpire,
+
+		ctx:   ctx,
+		abort: abort,
 	}
 	for _, tg := range targets {
 		tgUrl, _ := url.Parse(tg)
 		py := httputil.NewSingleHostReverseProxy(tgUrl)
+		py.Transport = tracing.Transport("proxy", metrics.InstrumentTransport("proxy", nil))
 		d := py.Director
 		py.Director = func(r *http.Request) {
 			d(r)
 			r.Host = tgUrl.Host
+			if f := handler.hub.getFileInfo(r.URL); f != nil {
+				handler.auth.injectToken(r, f)
+			} else if a := handler.hub.getApiInfo(r.URL); a != nil {
+				handler.auth.injectToken(r, a.repoFile())
+				// api responses are buffered into the meta cache uncompressed
+				r.Header.Del("Accept-Encoding")
+			}
 		}
 		py.ModifyResponse = func(response *http.Response) error {
 			code := response.StatusCode
 			switch response.Request.Method {
 			case http.MethodHead:
-				project, file, revision := getFileInfoFromHGUri(response.Request.URL)
+				f := handler.hub.getFileInfo(response.Request.URL)
 				meta := HfFileMetadata(response)
-				loc := ModifyHfFileLocation(handler.proxyUrl, meta)
-				meta.Tag = revision
+				loc := handler.hub.modifyFileLocation(handler.proxyUrl, meta)
 				meta.Location = loc
 				response.Header.Set("Location", loc)
-				if project != "" && file != "" && meta.Etag != "" && meta.Location != "" {
-					handler.metaCache.AppendMetadata(project, file, &meta)
+				if f != nil && meta.Etag != "" && meta.Location != "" {
+					meta.Tag = f.Revision
+					meta.Gated = handler.auth.isGated(f, requestToken(response.Request))
+					handler.storeFileMeta(f, &meta)
 				}
 			case http.MethodGet:
+				if a := handler.hub.getApiInfo(response.Request.URL); a != nil {
+					if code == http.StatusOK {
+						handler.storeApiResponse(a, response)
+					}
+					return nil
+				}
 				etag := handler.getEtagFromUri(response.Request)
 				rangeHeader := response.Request.Header.Get("Range")
 				if code == http.StatusOK && rangeHeader == "" && response.ContentLength > 0 && etag != "" {
-					host := response.Request.URL.Host
-					filePath := handler.fileCache.GetFilePath(etag)
-					fd, err := handler.fileCache.CreateBlobWriter(etag, response.ContentLength, func() {
-						if strings.Contains(host, "huggingface") {
-							handler.remoteCache.UploadFile(filePath)
-						}
-					})
+					fd, err := handler.createBlobWriter(etag, response.ContentLength, response.Request.URL.Host)
 					if err == nil {
 						response.Body = NewTeeReadCloser(response.Body, fd)
 					} else {
 						log.WithFields(log.Fields{"etag": etag}).Errorf("create local file writer failed, err:%v", err)
 					}
 				}
-				redirectUrl := response.Header.Get("Location")
-				if (code == http.StatusMovedPermanently || code == http.StatusFound) && redirectUrl != "" {
-					response.Header.Set("Location", handler.proxyUrl+redirectUrl)
+				if loc, ok := handler.hub.proxyRedirect(handler.proxyUrl, code, response.Request.URL, response.Header.Get("Location")); ok {
+					response.Header.Set("Location", loc)
 				}
 			}
 			return nil
@@ -112,46 +204,37 @@ func NewHFProxy(cfg *ProxyConfig, metaCache metacache.MetaDataCache, localCache
 	return handler
 }
 
-func ModifyHfFileLocation(proxyUrl string, meta metacache.FileMetadata) string {
-	if meta.Etag == "" || meta.Location == "" {
-		return ""
-	}
-	replacedLocation := meta.Location
-	if !strings.Contains(meta.Location, "cdn-lfs.huggingface.co") {
-		uriSubseqs := strings.Split(meta.Location, "/")
-		uriSubseqs[len(uriSubseqs)-2] = meta.CommitHash
-		replacedLocation = strings.Join(uriSubseqs, "/")
-	}
-	proxyLocation := proxyUrl + replacedLocation
-	locUrl, _ := url.Parse(proxyLocation)
-	if locUrl != nil {
-		vals := locUrl.Query()
-		vals.Set(INJECT_ETAG, meta.Etag)
-		locUrl.RawQuery = vals.Encode()
-		proxyLocation = locUrl.String()
-	}
-	return proxyLocation
-}
-
-func getFileInfoFromHGUri(uri *url.URL) (project, file, revision string) {
-	matches := HuggingfaceUrlReg.FindAllStringSubmatch(uri.String(), -1)
-	if len(matches) > 0 && len(matches[0]) == 3 {
-		project = matches[0][1]
-		revFile := strings.SplitN(matches[0][2], "/", 2)
-		if len(revFile) == 2 {
-			revision = revFile[0]
-			file = revFile[1]
+// withUpstreamTargets appends upstream endpoints missing from targets.
+func withUpstreamTargets(targets []string, upstreams []string) []string {
+	res := append([]string{}, targets...)
+	for _, up := range upstreams {
+		upUrl, err := url.Parse(up)
+		if err != nil {
+			continue
+		}
+		found := false
+		for _, tg := range targets {
+			if tgUrl, err := url.Parse(tg); err == nil && tgUrl.Host == upUrl.Host {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, upUrl.Scheme+"://"+upUrl.Host)
 		}
 	}
-	return project, file, revision
+	return res
 }
 
-func getEtagFromLfsUri(uri *url.URL) string {
-	matches := LfsHuggingfaceUrlReg.FindAllStringSubmatch(uri.String(), -1)
-	if len(matches) > 0 && len(matches[0]) == 3 {
-		return matches[0][2]
-	}
-	return ""
+// createBlobWriter creates a local blob writer for etag, blobs downloaded from
+// upstream are uploaded to the remote cache once they are complete.
+func (h *hfProxy) createBlobWriter(etag string, size int64, host string) (io.WriteCloser, error) {
+	filePath := h.fileCache.GetFilePath(etag)
+	return h.fileCache.CreateBlobWriter(etag, size, func() {
+		if h.hub.isUpstream(host) {
+			h.remoteCache.UploadFile(filePath)
+		}
+	})
 }
 
 func (h *hfProxy) getEtagFromUri(req *http.Request) (etag string) {
@@ -176,6 +259,9 @@ func HfFileMetadata(res *http.Response) metacache.FileMetadata {
 	location := resHeader.Get("Location")
 	if location == "" {
 		location = res.Request.URL.String()
+	} else if locUrl, err := res.Request.URL.Parse(location); err == nil {
+		// chained mirrors may answer with a relative location
+		location = locUrl.String()
 	}
 	size := resHeader.Get(HUGGINGFACE_HEADER_X_LINKED_SIZE)
 	if size == "" {
@@ -190,11 +276,22 @@ func HfFileMetadata(res *http.Response) metacache.FileMetadata {
 }
 
 func (h *hfProxy) ServeLocalFileMeta(rw http.ResponseWriter, req *http.Request) bool {
-	project, file, revision := getFileInfoFromHGUri(req.URL)
-	meta := h.metaCache.SearchMetaData(project, file, revision)
+	f := h.hub.getFileInfo(req.URL)
+	if f == nil {
+		return false
+	}
+	meta := h.metaCache.SearchMetaData(f.RepoKey(), f.Path, f.Revision)
 	if meta == nil {
 		return false
 	}
+	annotateFile(req, f)
+	annotateEtag(req, meta.Etag)
+	accesslog.FromContext(req.Context()).SetTier(metrics.TierMeta)
+	if meta.Gated && !h.auth.allowed(req, f.Owner(meta.CommitHash)) {
+		writeGatedError(rw, f.RepoKey())
+		return true
+	}
+	h.revalidate(f, meta, h.auth.token(req, f))
 	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	rw.Header().Set(HUGGINGFACE_HEADER_X_LINKED_SIZE, meta.Size)
 	rw.Header().Set(HUGGINGFACE_HEADER_X_REPO_COMMIT, meta.CommitHash)
@@ -203,7 +300,81 @@ func (h *hfProxy) ServeLocalFileMeta(rw http.ResponseWriter, req *http.Request)
 	rw.Header().Set(HUGGINGFACE_HEADER_X_LINKED_ETAG, fmt.Sprintf("\"%s\"", meta.Etag))
 	rw.Header().Set("Accept-Ranges", "bytes")
 	rw.WriteHeader(http.StatusOK)
-	log.WithFields(log.Fields{"file": file}).Infof("file meta hit cache:%s", req.URL.String())
+	log.WithFields(f.LogFields()).Infof("file meta hit cache:%s", req.URL.String())
+	return true
+}
+
+type blobAccess int
+
+const (
+	blobAllowed blobAccess = iota
+	blobDenied
+	// blobUnknown is a blob without owner record, e.g. cached before owners were
+	// persisted, it is not served from cache until upstream authorised a requester.
+	blobUnknown
+)
+
+// checkBlobAccess writes a gated error when etag belongs to a gated repo that
+// the requester is not authorised for.
+func (h *hfProxy) checkBlobAccess(rw http.ResponseWriter, req *http.Request, etag string) blobAccess {
+	owner := h.metaCache.GetBlobOwner(etag)
+	if owner == nil {
+		return blobUnknown
+	}
+	if owner.Public || h.auth.allowed(req, owner) {
+		return blobAllowed
+	}
+	writeGatedError(rw, hfFileFromOwner(owner).RepoKey())
+	return blobDenied
+}
+
+// serveBlob records that the blob download of req is served by tier, the
+// bytes written to the returned writer are counted as served by tier.
+func serveBlob(rw http.ResponseWriter, req *http.Request, tier string) http.ResponseWriter {
+	accesslog.FromContext(req.Context()).SetTier(tier)
+	return metrics.ServeBlob(rw, tier)
+}
+
+// annotateFile adds the file req addresses to its trace span and access log line.
+func annotateFile(req *http.Request, f *HfFile) {
+	tracing.SetAttributes(req.Context(), f.Attributes()...)
+	accesslog.FromContext(req.Context()).SetFile(string(f.Type), f.Repo, f.Revision, f.Path)
+}
+
+// annotateEtag adds the blob req resolved to to its trace span and access log line.
+func annotateEtag(req *http.Request, etag string) {
+	tracing.SetAttributes(req.Context(), attribute.String("hf.etag", etag))
+	accesslog.FromContext(req.Context()).SetEtag(etag)
+}
+
+// serveLocalFile serves etag from the local cache, it returns false when the
+// blob is not cached, e.g. it was evicted since it was looked up.
+func (h *hfProxy) serveLocalFile(rw http.ResponseWriter, req *http.Request, etag string) bool {
+	release, ok := h.fileCache.Acquire(etag)
+	defer release()
+	if !ok || !h.fileCache.HasFile(etag) {
+		return false
+	}
+	log.WithFields(log.Fields{"etag": etag}).Infof("file download hit cache")
+	rw = serveBlob(rw, req, metrics.TierLocal)
+	req.URL.Path = "/" + etag
+	req.URL.RawPath = "/" + etag
+	fileServe := h.fileCache.FileHandler()
+	fileServe.ServeHTTP(rw, req)
+	return true
+}
+
+// redirectRemote sends the client to a presigned url of the blob in the remote cache.
+func (h *hfProxy) redirectRemote(rw http.ResponseWriter, req *http.Request, filePath string) bool {
+	presigned, err := h.remoteCache.PresignRequest(filePath, h.ossRedirectExpire)
+	if err != nil {
+		log.WithFields(log.Fields{"file": filePath}).Errorf("presign remote oss url failed, err:%v", err)
+		return false
+	}
+	log.WithFields(log.Fields{"file": filePath}).Infof("redirect download to remote oss storage")
+	metrics.BlobRequests.WithLabelValues(metrics.TierRemote).Inc()
+	accesslog.FromContext(req.Context()).SetTier(metrics.TierRemote)
+	http.Redirect(rw, req, presigned, http.StatusFound)
 	return true
 }
 
@@ -224,62 +395,83 @@ func (h *hfProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		rw.Write([]byte("403: Host forbidden " + originUrl))
 		return
 	}
+	if h.offline {
+		h.serveOffline(rw, req)
+		return
+	}
 	if req.Method == http.MethodHead {
 		if h.ServeLocalFileMeta(rw, req) {
 			return
 		}
 	}
 	if req.Method == http.MethodGet {
+		if a := h.hub.getApiInfo(realUrl); a != nil && h.serveCachedApi(rw, req, a) {
+			return
+		}
 		etag := h.getEtagFromUri(req)
 		if etag == "" {
-			project, file, rev := getFileInfoFromHGUri(realUrl)
-			if project != "" && file != "" && rev != "" {
-				// https://huggingface.co
+			if f := h.hub.getFileInfo(realUrl); f != nil {
+				// hub resolve url
 				var meta *metacache.FileMetadata
-				meta = h.metaCache.SearchMetaData(project, file, rev)
+				annotateFile(req, f)
+				meta = h.metaCache.SearchMetaData(f.RepoKey(), f.Path, f.Revision)
+				token := h.auth.token(req, f)
+				if meta != nil && h.metaCache.GetBlobOwner(meta.Etag) == nil {
+					// resolve again to learn whether the blob is gated
+					meta = nil
+				}
 				if meta == nil {
-					metaSource := h.hgClient.FileMeta(project, file, rev)
-					loc := ModifyHfFileLocation(h.proxyUrl, metaSource)
-					metaSource.Tag = rev
-					metaSource.Location = loc
-					if metaSource.Etag != "" && metaSource.Location != "" {
-						h.metaCache.AppendMetadata(project, file, &metaSource)
-					}
+					metaSource := h.fetchFileMeta(req.Context(), f, token)
 					meta = &metaSource
+				} else {
+					h.revalidate(f, meta, token)
 				}
 				req.Header.Set(INJECT_ETAG, meta.Etag)
 				etag = meta.Etag
 			} else {
-				// https://cdn-lfs.huggingface.co
-				etag = getEtagFromLfsUri(realUrl)
+				// lfs url
+				etag = h.hub.getLfsEtag(realUrl)
 				req.Header.Set(INJECT_ETAG, etag)
 			}
 		}
 		if etag != "" {
-			if h.fileCache.HasFile(etag) {
-				log.WithFields(log.Fields{"etag": etag}).Infof("file download hit cache")
-				req.URL.Path = "/" + etag
-				req.URL.RawPath = "/" + etag
-				fileServe := h.fileCache.FileHandler()
-				fileServe.ServeHTTP(rw, req)
+			annotateEtag(req, etag)
+			access := h.checkBlobAccess(rw, req, etag)
+			if access == blobDenied {
 				return
 			}
-			filePath := h.fileCache.GetFilePath(etag)
-			if err = h.remoteCache.StatFile(filePath); err == nil {
-				remoteUrlStr, err := h.remoteCache.GetRequest(filePath)
-				if err == nil && remoteUrlStr != "" {
-					remoteUrl, err := url.Parse(remoteUrlStr)
-					remoteStorageProxy := h.targetsProxy[remoteUrl.Host]
-					if err == nil && remoteStorageProxy != nil {
-						log.WithFields(log.Fields{"url": remoteUrlStr}).Infof("downloading from remote oss storage")
-						req.URL = remoteUrl
-						remoteStorageProxy.ServeHTTP(rw, req)
+			if access == blobUnknown {
+				// upstream authorises the download
+				log.WithFields(log.Fields{"etag": etag}).Warnf("blob owner unknown, bypass cache")
+			} else {
+				if h.serveLocalFile(rw, req, etag) {
+					return
+				}
+				filePath := h.fileCache.GetFilePath(etag)
+				if err = h.remoteCache.StatFile(req.Context(), filePath); err == nil {
+					if h.ossRedirect && h.redirectRemote(rw, req, filePath) {
+						h.fillFromRemote(etag, filePath)
+						return
+					}
+					if h.serveRemote(rw, req, etag, filePath) {
+						return
+					}
+				}
+				if req.Header.Get("Range") == "" {
+					if h.coalesce(rw, req, etag, metrics.TierUpstream, h.upstreamFetch(req, etag)) {
+						return
+					}
+				} else {
+					if h.servePartial(rw, req, etag) {
 						return
 					}
+					h.fillInBackground(req, etag)
 				}
 			}
+			rw = serveBlob(rw, req, metrics.TierUpstream)
 		}
 	}
 	proxy := h.targetsProxy[realUrl.Host]
+	accesslog.FromContext(req.Context()).SetTier(metrics.TierUpstream)
 	proxy.ServeHTTP(rw, req)
 }
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hf-mirror/metrics"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// serveRemote streams a blob from the remote cache to the client, full
+// downloads are filled into the local cache and followed from there so that
+// the bucket acts as a second tier. Ranges are served from the bucket while the
+// whole blob is filled in the background. It returns false when nothing was written.
+func (h *hfProxy) serveRemote(rw http.ResponseWriter, req *http.Request, etag, filePath string) bool {
+	rng := req.Header.Get("Range")
+	if rng != "" {
+		if h.servePartial(rw, req, etag) {
+			return true
+		}
+		h.fillFromRemote(etag, filePath)
+	} else if h.coalesce(rw, req, etag, metrics.TierRemote, h.remoteFetch(filePath, etag)) {
+		return true
+	}
+	obj, err := h.remoteCache.Download(req.Context(), filePath, rng)
+	if err != nil {
+		log.WithFields(log.Fields{"etag": etag}).Errorf("download from remote oss storage failed, err:%v", err)
+		return false
+	}
+	defer obj.Body.Close()
+	log.WithFields(log.Fields{"etag": etag, "range": rng}).Infof("downloading from remote oss storage")
+	rw = serveBlob(rw, req, metrics.TierRemote)
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Length", strconv.FormatInt(obj.ContentLength, 10))
+	rw.Header().Set("ETag", fmt.Sprintf("\"%s\"", etag))
+	rw.Header().Set("Accept-Ranges", "bytes")
+	status := http.StatusOK
+	if obj.ContentRange != "" {
+		rw.Header().Set("Content-Range", obj.ContentRange)
+		status = http.StatusPartialContent
+	}
+	rw.WriteHeader(status)
+	if _, err = io.Copy(rw, obj.Body); err != nil {
+		log.WithFields(log.Fields{"etag": etag}).Warnf("stream from remote oss storage failed, err:%v", err)
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"hf-mirror/metacache"
+	"net/url"
+	"strings"
+)
+
+type RepoType string
+
+const (
+	RepoTypeModel   RepoType = "model"
+	RepoTypeDataset RepoType = "dataset"
+	RepoTypeSpace   RepoType = "space"
+)
+
+// repoTypePrefixes are the url path prefixes of each repo type, models have none.
+var repoTypePrefixes = map[string]RepoType{
+	"models":   RepoTypeModel,
+	"datasets": RepoTypeDataset,
+	"spaces":   RepoTypeSpace,
+}
+
+// HfFile is a file of a hub repo at a revision, as addressed by
+// {hub}/[datasets/|spaces/]{repo id}/resolve/{revision}/{path}.
+type HfFile struct {
+	Type RepoType
+	// Repo is the repo id, "namespace/name" or a legacy canonical "name" like "gpt2".
+	Repo string
+	// Revision is unescaped, e.g. "refs/pr/1".
+	Revision string
+	Path     string
+}
+
+// RepoUrlPath is the repo part of hub urls, e.g. "datasets/glue".
+func (f *HfFile) RepoUrlPath() string {
+	if f.Type == RepoTypeModel || f.Type == "" {
+		return f.Repo
+	}
+	return string(f.Type) + "s/" + f.Repo
+}
+
+// RepoKey identifies the repo in caches and logs regardless of its url form, e.g. "models/gpt2".
+func (f *HfFile) RepoKey() string {
+	t := f.Type
+	if t == "" {
+		t = RepoTypeModel
+	}
+	return string(t) + "s/" + f.Repo
+}
+
+func (f *HfFile) LogFields() log.Fields {
+	return log.Fields{
+		"repo_type": f.Type,
+		"repo":      f.Repo,
+		"revision":  f.Revision,
+		"file":      f.Path,
+	}
+}
+
+// Attributes describe f on trace spans.
+func (f *HfFile) Attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("hf.repo_type", string(f.Type)),
+		attribute.String("hf.repo", f.Repo),
+		attribute.String("hf.revision", f.Revision),
+		attribute.String("hf.file", f.Path),
+	}
+}
+
+func (f *HfFile) Owner(commitHash string) *metacache.BlobOwner {
+	return &metacache.BlobOwner{
+		RepoType: string(f.Type),
+		Project:  f.Repo,
+		File:     f.Path,
+		Revision: commitHash,
+	}
+}
+
+func hfFileFromOwner(owner *metacache.BlobOwner) *HfFile {
+	t := RepoType(owner.RepoType)
+	if t == "" {
+		t = RepoTypeModel
+	}
+	return &HfFile{
+		Type:     t,
+		Repo:     owner.Project,
+		Revision: owner.Revision,
+		Path:     owner.File,
+	}
+}
+
+// parseRepoPath splits an escaped url path below the hub endpoint into the repo
+// and what follows "/{verb}/", e.g. "datasets/glue/resolve/main/x.json" with verb "resolve".
+func parseRepoPath(escapedPath, verb string) (repoType RepoType, repo string, rest []string, ok bool) {
+	segs := strings.Split(strings.Trim(escapedPath, "/"), "/")
+	repoType = RepoTypeModel
+	if t, found := repoTypePrefixes[segs[0]]; found && len(segs) > 1 {
+		repoType = t
+		segs = segs[1:]
+	}
+	// prefer "namespace/name" over a legacy canonical "name"
+	for _, idLen := range []int{2, 1} {
+		if len(segs) > idLen && segs[idLen] == verb {
+			ids := make([]string, idLen)
+			for i, s := range segs[:idLen] {
+				id, err := url.PathUnescape(s)
+				if err != nil || id == "" {
+					return "", "", nil, false
+				}
+				ids[i] = id
+			}
+			return repoType, strings.Join(ids, "/"), segs[idLen+1:], true
+		}
+	}
+	return "", "", nil, false
+}
+
+func parseHfFile(escapedPath string) *HfFile {
+	repoType, repo, rest, ok := parseRepoPath(escapedPath, "resolve")
+	if !ok || len(rest) < 2 {
+		return nil
+	}
+	revision, err := url.PathUnescape(rest[0])
+	if err != nil || revision == "" {
+		return nil
+	}
+	file, err := url.PathUnescape(strings.Join(rest[1:], "/"))
+	if err != nil || file == "" {
+		return nil
+	}
+	return &HfFile{
+		Type:     repoType,
+		Repo:     repo,
+		Revision: revision,
+		Path:     file,
+	}
+}
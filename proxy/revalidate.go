@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"hf-mirror/metacache"
+)
+
+// fetchFileMeta resolves file metadata from upstream and stores it in the meta cache.
+func (h *hfProxy) fetchFileMeta(ctx context.Context, f *HfFile, token string) metacache.FileMetadata {
+	meta := h.hgClient.FileMeta(ctx, f, token)
+	loc := h.hub.modifyFileLocation(h.proxyUrl, meta)
+	meta.Tag = f.Revision
+	meta.Location = loc
+	if meta.Etag != "" && meta.Location != "" {
+		meta.Gated = h.auth.isGated(f, token)
+		h.storeFileMeta(f, &meta)
+	}
+	return meta
+}
+
+// storeFileMeta appends meta to the meta cache and remembers the owner of its blob.
+// A blob that is public in any repo stays public, the same bytes are readable anyway.
+func (h *hfProxy) storeFileMeta(f *HfFile, meta *metacache.FileMetadata) {
+	h.metaCache.AppendMetadata(f.RepoKey(), f.Path, meta)
+	owner := f.Owner(meta.CommitHash)
+	owner.Public = !meta.Gated
+	if !owner.Public {
+		if prev := h.metaCache.GetBlobOwner(meta.Etag); prev != nil && prev.Public {
+			return
+		}
+	}
+	h.metaCache.SetBlobOwner(meta.Etag, owner)
+}
+
+// revalidate refreshes cached metadata of a mutable revision in the background
+// once it is older than revalidateAfter, the stale entry keeps being served meanwhile.
+func (h *hfProxy) revalidate(f *HfFile, meta *metacache.FileMetadata, token string) {
+	if h.offline || metacache.IsCommitHash(f.Revision) || !meta.Stale(h.revalidateAfter) {
+		return
+	}
+	key := f.RepoKey() + "/" + f.Revision + "/" + f.Path
+	if _, loaded := h.revalidating.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	started := h.goBackground(func(ctx context.Context) {
+		defer h.revalidating.Delete(key)
+		fresh := h.fetchFileMeta(ctx, f, token)
+		if fresh.Etag == "" {
+			log.WithFields(f.LogFields()).Warnf("revalidate file meta failed, keep serving stale entry")
+			return
+		}
+		if fresh.CommitHash != meta.CommitHash {
+			log.WithFields(f.LogFields()).Infof("revision moved from %v to %v", meta.CommitHash, fresh.CommitHash)
+		}
+	})
+	if !started {
+		h.revalidating.Delete(key)
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"hf-mirror/metacache"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRevalidateStaleBranch(t *testing.T) {
+	var heads int32
+	release := make(chan struct{})
+	hub := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&heads, 1)
+		<-release
+		rw.Header().Set(HUGGINGFACE_HEADER_X_REPO_COMMIT, "c2")
+		rw.Header().Set("ETag", `"e2"`)
+		rw.Header().Set("Content-Length", "2")
+	}))
+	defer hub.Close()
+	env := newAdminTestEnv(t, hub.URL)
+	h := env.proxy
+	// every cached entry of a branch is stale right away
+	h.revalidateAfter = time.Nanosecond
+	f := &HfFile{Type: RepoTypeModel, Repo: "org/model", Revision: "main", Path: "config.json"}
+	h.storeFileMeta(f, &metacache.FileMetadata{Tag: "main", CommitHash: "c1", Etag: "e1", Location: hub.URL, Size: "1"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodHead, "/"+hub.URL+"/org/model/resolve/main/config.json", nil))
+			if got := rw.Header().Get(HUGGINGFACE_HEADER_X_REPO_COMMIT); got != "c1" {
+				t.Errorf("stale entry not served, commit %q", got)
+			}
+		}()
+	}
+	// the stale entry is served while the revalidation hangs on the hub
+	wg.Wait()
+	close(release)
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		if meta := h.metaCache.SearchMetaData(f.RepoKey(), f.Path, "main"); meta != nil && meta.CommitHash == "c2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale entry not revalidated")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if n := atomic.LoadInt32(&heads); n != 1 {
+		t.Errorf("hub resolved the file %d times, want one revalidation", n)
+	}
+}
+
+func TestShutdownAbortsRevalidation(t *testing.T) {
+	started := make(chan struct{})
+	hub := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-req.Context().Done()
+	}))
+	defer hub.Close()
+	env := newAdminTestEnv(t, hub.URL)
+	h := env.proxy
+	f := &HfFile{Type: RepoTypeModel, Repo: "org/model", Revision: "main", Path: "config.json"}
+	stale := &metacache.FileMetadata{Tag: "main", CommitHash: "c1", Etag: "e1", UpdatedAt: time.Now().Add(-h.revalidateAfter * 2).Unix()}
+	h.revalidate(f, stale, "")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	begin := time.Now()
+	err := Shutdown(ctx, h)
+	if err == nil || !strings.Contains(err.Error(), "aborted 1") {
+		t.Errorf("shutdown did not abort the revalidation, err:%v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > abortGrace {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+	if _, ok := h.revalidating.Load(f.RepoKey() + "/main/config.json"); ok {
+		t.Error("aborted revalidation still registered")
+	}
+
+	// revalidations are not started once the shutdown began
+	h.revalidate(f, stale, "")
+	if _, ok := h.revalidating.Load(f.RepoKey() + "/main/config.json"); ok {
+		t.Error("revalidation started during shutdown")
+	}
+}
@@ -0,0 +1,114 @@
+package tracing
+
+import (
+	"context"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const instrumentationName = "hf-mirror"
+
+type Config struct {
+	// Endpoint is the host:port of an OTLP/HTTP collector, tracing is disabled when it is empty.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure exports over plain http, e.g. to a collector on localhost.
+	Insecure bool `yaml:"insecure"`
+	// Headers are sent with every export, e.g. for authentication.
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"`
+	// SampleRatio is the share of traces sampled that do not have a sampled parent already.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Endpoint:    "",
+		Insecure:    true,
+		Headers:     map[string]string{},
+		ServiceName: "hf-mirror",
+		SampleRatio: 1,
+	}
+}
+
+// Init installs the OTLP exporter and the W3C trace context propagator, the
+// returned shutdown flushes pending spans. Spans are no-ops while disabled.
+func Init(cfg *Config) (shutdown func(context.Context) error, err error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(cfg.Endpoint),
+		otlptracehttp.WithHeaders(cfg.Headers),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Start starts a span of the mirror below the span of ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SetAttributes adds attrs to the span of ctx.
+func SetAttributes(ctx context.Context, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
+
+// Handler starts a server span for every request, continuing the trace of the
+// client's traceparent header. Requests for which skip returns true are not traced.
+func Handler(next http.Handler, skip func(req *http.Request) bool) http.Handler {
+	return otelhttp.NewHandler(next, "ServeHTTP",
+		otelhttp.WithFilter(func(req *http.Request) bool { return skip == nil || !skip(req) }),
+		otelhttp.WithSpanNameFormatter(func(operation string, req *http.Request) string {
+			return operation + " " + req.Method
+		}),
+	)
+}
+
+// Transport starts a client span named after client for every request sent through rt.
+func Transport(client string, rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(rt, otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+		return client + " " + req.Method
+	}))
+}
@@ -0,0 +1,24 @@
+package units
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	valid := map[string]ByteSize{
+		"0":      0,
+		"1024":   1024,
+		"512MiB": 512 << 20,
+		"1.5KB":  1500,
+		" 10GB ": 10 * 1000 * 1000 * 1000,
+		"2B":     2,
+	}
+	for s, want := range valid {
+		if got, err := ParseByteSize(s); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "-5", "-5GB", "0.3B", "1.0001KB", "NaNGB", "InfB", "1e30TB", "10XB"} {
+		if got, err := ParseByteSize(s); err == nil {
+			t.Errorf("%q: got %v, want an error", s, got)
+		}
+	}
+}